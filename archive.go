@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/fruktkartan/fruktsam/internal/archive"
+	"github.com/fruktkartan/fruktsam/internal/history"
+	"github.com/fruktkartan/fruktsam/internal/trees"
+	"github.com/fruktkartan/fruktsam/internal/util"
+	"github.com/fruktkartan/fruktsam/internal/window"
+	"github.com/jmoiron/sqlx"
+)
+
+type archivePageData struct {
+	History      *history.History
+	Now          string
+	DatabaseName string
+	Base         string
+	Filter       string
+}
+
+type archiveIndexData struct {
+	Pages        []archive.Page
+	Now          string
+	DatabaseName string
+}
+
+// openArchive opens the archive of the report, if it has one, and finds
+// the periods that have new history since last time. Periods are looked
+// up in the database once per kind of period, in periods.
+func openArchive(ctx context.Context, db sqlx.QueryerContext, cfg *config, r *report,
+	periods map[window.Period][]history.PeriodStat,
+) error {
+	if r.Archive == "" {
+		return nil
+	}
+
+	period, err := window.ParsePeriod(r.Archive)
+	if err != nil {
+		return fmt.Errorf("report %s: archive: %w", r.Name, err)
+	}
+
+	if r.archive, err = archive.Open(r.Dest, period, cfg.pagesHash(r.reportConfig)); err != nil {
+		return err
+	}
+
+	if _, ok := periods[period]; !ok {
+		if periods[period], err = history.PeriodsFromDB(ctx, db, period); err != nil {
+			return err
+		}
+	}
+
+	r.stale = r.archive.Stale(periods[period])
+	slog.Info(fmt.Sprintf("Report %s: archive: %d of %d pages to generate",
+		r.Name, len(r.stale), len(periods[period])))
+
+	return nil
+}
+
+// writeArchive writes the archive pages of the stale periods, and the
+// archive index. Gives the images used on the pages.
+func (rr *reportRun) writeArchive(r *report, t trees.Trees) ([]string, error) {
+	var images []string
+
+	for _, ps := range r.stale {
+		w, err := r.archive.Period.Window(ps.Key)
+		if err != nil {
+			return nil, err
+		}
+		h := rr.history.Sub(w)
+		h.Filter(r.filter, t.Has)
+		pageImages := h.ImageFiles()
+		images = append(images, pageImages...)
+
+		page := archivePageData{
+			History:      h,
+			Now:          util.FormatDateTime(rr.now),
+			DatabaseName: rr.databaseName,
+			Base:         "../",
+			Filter:       r.filter.String(),
+		}
+		if err = renderFile(r.tmpl, "tmpl_archive.html", &page, r.archive.PagePath(ps.Key)); err != nil {
+			return nil, err
+		}
+		r.archive.Generated(ps, pageImages)
+	}
+
+	index := archiveIndexData{
+		Pages:        r.archive.Pages(),
+		Now:          util.FormatDateTime(rr.now),
+		DatabaseName: rr.databaseName,
+	}
+	if err := renderFile(r.tmpl, "tmpl_archive_index.html", &index, r.archive.IndexPath()); err != nil {
+		return nil, err
+	}
+
+	return images, r.archive.Save()
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/fruktkartan/fruktsam/internal/filter"
+	"github.com/fruktkartan/fruktsam/internal/taxonomy"
+	"github.com/fruktkartan/fruktsam/internal/window"
+)
+
+const (
+	defaultDays     = 90
+	defaultInterval = time.Hour
+)
+
+// config is what to do in one run, from a config file or from flags
+type config struct {
+	// Where the reversecache and image thumbnails are kept, and shared
+	// between the reports. Defaults to dest of the first report.
+	CacheDir  string `toml:"cache_dir"`
+	Lang      string `toml:"lang"`
+	TZ        string `toml:"tz"`
+	Taxonomy  string `toml:"taxonomy"`
+	FlagTypes string `toml:"flagtypes"`
+	Tables    string `toml:"tables"`
+	Compare   bool   `toml:"compare_images"`
+	Thumbs    []int  `toml:"thumb_sizes"`
+	Images    string `toml:"images"`
+	GCThumbs  bool   `toml:"gc_thumbs"`
+	RunJSON   string `toml:"run_json"`
+	Strict    bool   `toml:"strict"`
+
+	// Address lookups in a run for filters and galleries
+	MaxLookups int `toml:"max_lookups"`
+	// Image fetches in a run for galleries
+	MaxFetches int `toml:"max_fetches"`
+
+	MetricsFile string        `toml:"metrics_file"`
+	Serve       string        `toml:"serve"`    // address to serve metrics on, between runs
+	Interval    time.Duration `toml:"interval"` // between runs when serving
+	Timeout     time.Duration `toml:"timeout"`  // of a run, 0 for none
+
+	Reports []reportConfig `toml:"reports"`
+}
+
+type reportConfig struct {
+	Name string `toml:"name"`
+	Dest string `toml:"dest"`
+
+	// Window, at most one of these ways of giving it
+	Days         *int   `toml:"days"`
+	From         string `toml:"from"`
+	To           string `toml:"to"`
+	Week         string `toml:"week"`
+	Month        string `toml:"month"`
+	SinceLastRun bool   `toml:"since_last_run"`
+
+	Archive  string       `toml:"archive"`
+	Gallery  bool         `toml:"gallery"`
+	Template string       `toml:"template"` // directory overriding templates
+	Filter   filterConfig `toml:"filter"`
+}
+
+type filterConfig struct {
+	Types          []string `toml:"types"`
+	By             []string `toml:"by"`
+	Ops            []string `toml:"ops"`
+	BBox           string   `toml:"bbox"`
+	Municipalities []string `toml:"municipalities"`
+}
+
+func loadConfig(file string) (*config, error) {
+	var c config
+	md, err := toml.DecodeFile(file, &c)
+	if err != nil {
+		return nil, fmt.Errorf("failed DecodeFile: %w", err)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return nil, fmt.Errorf("%s: unknown keys: %v", file, undecoded)
+	}
+	return &c, nil
+}
+
+// check validates the config and makes paths absolute
+func (c *config) check() error {
+	if len(c.Reports) == 0 {
+		return fmt.Errorf("no reports configured")
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("failed Getwd: %w", err)
+	}
+	abs := func(dir string) string {
+		if filepath.IsAbs(dir) {
+			return dir
+		}
+		return filepath.Join(cwd, dir)
+	}
+
+	dests := make(map[string]bool)
+	for idx := range c.Reports {
+		r := &c.Reports[idx]
+		if r.Dest == "" {
+			return fmt.Errorf("report %d has no dest", idx+1)
+		}
+		r.Dest = abs(r.Dest)
+		if dests[r.Dest] {
+			return fmt.Errorf("dest %s is used by more than one report", r.Dest)
+		}
+		dests[r.Dest] = true
+		if r.Template != "" {
+			r.Template = abs(r.Template)
+		}
+		if r.Name == "" {
+			r.Name = filepath.Base(r.Dest)
+		}
+	}
+
+	for _, size := range c.Thumbs {
+		if size <= 0 {
+			return fmt.Errorf("thumb size %d is not positive", size)
+		}
+	}
+
+	if c.MaxLookups == 0 {
+		c.MaxLookups = defaultMaxLookups
+	}
+	if c.MaxLookups < 0 {
+		return fmt.Errorf("max_lookups %d is negative", c.MaxLookups)
+	}
+	if c.MaxFetches == 0 {
+		c.MaxFetches = defaultMaxFetches
+	}
+	if c.MaxFetches < 0 {
+		return fmt.Errorf("max_fetches %d is negative", c.MaxFetches)
+	}
+
+	if c.Interval == 0 {
+		c.Interval = defaultInterval
+	}
+	if c.Interval < time.Minute {
+		return fmt.Errorf("interval %s is shorter than a minute", c.Interval)
+	}
+
+	if c.CacheDir == "" {
+		c.CacheDir = c.Reports[0].Dest
+	}
+	c.CacheDir = abs(c.CacheDir)
+
+	return nil
+}
+
+// pagesHash identifies what the pages of the report are made with, other
+// than the history: the filter, templates and the global config that
+// changes how they look. Not the window, nor where they are written.
+func (c *config) pagesHash(r reportConfig) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%#v", struct {
+		Lang, TZ, Taxonomy, FlagTypes, Tables string
+		Compare                               bool
+		Thumbs                                []int
+		Images                                string
+		Template                              string
+		Filter                                filterConfig
+	}{
+		c.Lang, c.TZ, c.Taxonomy, c.FlagTypes, c.Tables,
+		c.Compare, c.Thumbs, c.Images, r.Template, r.Filter,
+	})
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// window gives the history window of the report
+func (r *reportConfig) window(now time.Time) (window.Window, error) {
+	var given []string
+	if r.Days != nil {
+		given = append(given, "days (-s)")
+	}
+	if r.From != "" || r.To != "" {
+		given = append(given, "from/to")
+	}
+	if r.Week != "" {
+		given = append(given, "week")
+	}
+	if r.Month != "" {
+		given = append(given, "month")
+	}
+	if r.SinceLastRun {
+		given = append(given, "since_last_run")
+	}
+	if len(given) > 1 {
+		return window.Window{}, fmt.Errorf("report %s: only one of %s can be used",
+			r.Name, strings.Join(given, ", "))
+	}
+
+	days := defaultDays
+	if r.Days != nil {
+		days = *r.Days
+	}
+
+	switch {
+	case r.From != "" || r.To != "":
+		return window.Range(r.From, r.To)
+	case r.Week != "":
+		return window.Week(r.Week)
+	case r.Month != "":
+		return window.Month(r.Month)
+	case r.SinceLastRun:
+		w, ok, err := window.SinceLastRun(r.Dest)
+		if err != nil {
+			return w, err
+		}
+		if ok {
+			return w, nil
+		}
+		slog.Info(fmt.Sprintf("Report %s: no last run recorded, using past %d days", r.Name, days))
+	}
+	return window.Days(days, now), nil
+}
+
+func (fc *filterConfig) build(tx *taxonomy.Taxonomy, places filter.Places) (*filter.Filter, error) {
+	f := filter.Filter{
+		Types:          fc.Types,
+		By:             fc.By,
+		Municipalities: fc.Municipalities,
+		Taxonomy:       tx,
+		Places:         places,
+	}
+	var err error
+	if f.Ops, err = filter.ParseOps(strings.Join(fc.Ops, ",")); err != nil {
+		return nil, err
+	}
+	if fc.BBox != "" {
+		if f.BBox, err = filter.ParseBBox(fc.BBox); err != nil {
+			return nil, err
+		}
+	}
+	return &f, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq" // for sqlx
+)
+
+// openDB opens the database pool, shared by the runs. It connects when
+// first used.
+func openDB(dbURL string) (*sqlx.DB, error) {
+	db, err := sqlx.Open("postgres", dbURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed Open: %w", err)
+	}
+	// A run reads in one transaction at a time
+	db.SetMaxOpenConns(2)
+	db.SetMaxIdleConns(1)
+	// With -serve, do not keep a connection between runs
+	db.SetConnMaxIdleTime(5 * time.Minute)
+	db.SetConnMaxLifetime(time.Hour)
+	return db, nil
+}
+
+// beginSnapshot begins a read only transaction that sees the database as
+// it was at its first query, so that the trees and the history read in it
+// agree.
+func beginSnapshot(ctx context.Context, db *sqlx.DB) (*sqlx.Tx, error) {
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed BeginTx: %w", err)
+	}
+	return tx, nil
+}
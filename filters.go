@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/fruktkartan/fruktsam/internal/filter"
+	"github.com/fruktkartan/fruktsam/internal/reversecache"
+	"github.com/fruktkartan/fruktsam/internal/types"
+)
+
+type filterFlags struct {
+	types, by, ops, bbox, municipalities string
+}
+
+func (ff *filterFlags) register() {
+	flag.StringVar(&ff.types, "type", "", "Only trees of these comma separated `types` (raw, species or category)")
+	flag.StringVar(&ff.by, "by", "", "Only trees and changes by these comma separated `contributors`")
+	flag.StringVar(&ff.ops, "op", "", "Only these comma separated kinds of `changes`: insert, delete, update")
+	flag.StringVar(&ff.bbox, "bbox", "", "Only trees within `minlat,minlon,maxlat,maxlon`")
+	flag.StringVar(&ff.municipalities, "municipality", "",
+		"Only trees in these comma separated `municipalities`, see -max-lookups")
+}
+
+func (ff *filterFlags) config() filterConfig {
+	return filterConfig{
+		Types:          filter.List(ff.types),
+		By:             filter.List(ff.by),
+		Ops:            filter.List(ff.ops),
+		BBox:           ff.bbox,
+		Municipalities: filter.List(ff.municipalities),
+	}
+}
+
+// defaultMaxLookups is the default of max_lookups. At a lookup a second,
+// it is a few minutes of a run.
+const defaultMaxLookups = 200
+
+var errLookupLimit = errors.New(
+	"the address lookups of the run (max_lookups) are used up, run again to look up more")
+
+var errNoAddress = errors.New("lookup got nothing")
+
+// lookupPlaces gets addresses for positions that are not yet in the
+// reverse cache, for filters and galleries, which need the address of
+// every tree. As nominatim does not allow bulk lookups, there are at most
+// max lookups in a run, the rest are left to later runs. Lookups stop when
+// ctx is done.
+type lookupPlaces struct {
+	ctx context.Context
+	rc  *reversecache.ReverseCache
+	max int
+	n   int   // lookups so far
+	err error // why a municipality was not known, see Err
+}
+
+// Municipality is used by filters. When it can not be looked up, the
+// report can not be filtered right, and Err tells why.
+func (lp *lookupPlaces) Municipality(p types.Pos) string {
+	if err := lp.lookup(p); err != nil && lp.err == nil {
+		lp.err = fmt.Errorf("filter on municipality: no address for %v: %w", p, err)
+	}
+	return lp.rc.Municipality(p)
+}
+
+func (lp *lookupPlaces) Locality(p types.Pos) string {
+	_ = lp.lookup(p)
+	return lp.rc.Locality(p)
+}
+
+// Err is why a filter could not get a municipality, nil if it could get
+// them all
+func (lp *lookupPlaces) Err() error {
+	return lp.err
+}
+
+func (lp *lookupPlaces) lookup(p types.Pos) error {
+	if lp.rc.Has(p) {
+		return nil
+	}
+	if err := lp.ctx.Err(); err != nil {
+		return err
+	}
+	if lp.n >= lp.max {
+		return errLookupLimit
+	}
+	lp.n++
+	lp.rc.Ensure(lp.ctx, p, fmt.Sprintf("%v", p))
+	if !lp.rc.Has(p) {
+		// Interrupted, or nominatim failed
+		if err := lp.ctx.Err(); err != nil {
+			return err
+		}
+		return errNoAddress
+	}
+	return nil
+}
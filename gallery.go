@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"sort"
+
+	"github.com/fruktkartan/fruktsam/internal/history"
+	"github.com/fruktkartan/fruktsam/internal/taxonomy"
+	"github.com/fruktkartan/fruktsam/internal/trees"
+	"github.com/fruktkartan/fruktsam/internal/types"
+	"github.com/fruktkartan/fruktsam/internal/util"
+)
+
+const galleryFile = "gallery.html"
+
+// defaultMaxFetches is the default of max_fetches. A first gallery would
+// otherwise fetch every image in the bucket, one by one.
+const defaultMaxFetches = 500
+
+// galleryData is the data of the gallery page, see TEMPLATES.md
+type galleryData struct {
+	Types        []galleryType
+	Count        int // trees in the gallery
+	Now          string
+	DatabaseName string
+	Filter       string
+}
+
+type galleryType struct {
+	Type       string // species in the taxonomy, or the normalized type if not in it
+	Count      int
+	Localities []galleryLocality
+}
+
+type galleryLocality struct {
+	Locality string // empty if unknown
+	Trees    []galleryTree
+}
+
+type galleryTree struct {
+	Key    string
+	Desc   string
+	At     string
+	Img    string // thumbnail, relative to the page
+	Srcset string
+	Error  string // why the image could not be processed, then Img is a placeholder
+}
+
+// writeGallery makes thumbnails of the images of the trees, and writes the
+// gallery page with them. Gives the images used on the page.
+//
+// Images that have no thumbnails yet are fetched within the fetches of the
+// run (max_fetches), the trees of the rest are left out until a later run
+// has fetched them. The locality of a tree is looked up if not in the
+// reversecache, within the lookups of the run (max_lookups). Trees left
+// without are shown under unknown locality, until a later run has looked
+// them up.
+func (rr *reportRun) writeGallery(ctx context.Context, r *report, t trees.Trees) ([]string, error) {
+	byType := make(map[string]map[string][]galleryTree)
+	var images []string
+	count := 0
+	notLookedUp, notFetched := 0, 0
+
+	for _, e := range t.Entries() {
+		img := e.Img.String()
+		if img == "" {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if !rr.history.HasThumbs(img) {
+			if rr.fetches >= rr.maxFetches {
+				notFetched++
+				continue
+			}
+			rr.fetches++
+		}
+		thumb := history.Thumb{Name: img}
+		if err := rr.history.CreateImageThumb(ctx, img); err != nil {
+			thumb.Error = err.Error()
+		}
+		images = append(images, thumb.Files()...)
+
+		var locality string
+		if e.Lat.Valid && e.Lon.Valid {
+			p := types.Pos{Lat: e.Lat.Float64, Lon: e.Lon.Float64}
+			locality = rr.places.Locality(p)
+			if !rr.reverseCache.Has(p) {
+				notLookedUp++
+			}
+		}
+		typ := t.Taxonomy.Key(e.Type.String(), taxonomy.LevelSpecies)
+		if byType[typ] == nil {
+			byType[typ] = make(map[string][]galleryTree)
+		}
+		byType[typ][locality] = append(byType[typ][locality], galleryTree{
+			Key:    e.Key.String(),
+			Desc:   e.Desc.String(),
+			At:     e.At.Date(),
+			Img:    thumb.File(),
+			Srcset: thumb.Srcset(""),
+			Error:  thumb.Error,
+		})
+		count++
+	}
+
+	data := galleryData{
+		Types:        galleryTypes(byType),
+		Count:        count,
+		Now:          util.FormatDateTime(rr.now),
+		DatabaseName: rr.databaseName,
+		Filter:       r.filter.String(),
+	}
+	slog.Info(fmt.Sprintf("Report %s: gallery of %d trees", r.Name, count))
+	if notLookedUp > 0 {
+		slog.Info(fmt.Sprintf("Report %s: gallery has %d trees under unknown locality, to be looked up in later runs",
+			r.Name, notLookedUp))
+	}
+	if notFetched > 0 {
+		slog.Info(fmt.Sprintf("Report %s: gallery leaves out %d trees whose images are fetched in later runs (max_fetches)",
+			r.Name, notFetched))
+	}
+	if err := renderFile(r.tmpl, "tmpl_gallery.html", &data, filepath.Join(r.Dest, galleryFile)); err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+// galleryTypes sorts the trees by type and then locality, with unknown
+// locality last
+func galleryTypes(byType map[string]map[string][]galleryTree) []galleryType {
+	gts := make([]galleryType, 0, len(byType))
+	for typ, byLocality := range byType {
+		gt := galleryType{Type: typ}
+		for locality, ts := range byLocality {
+			gt.Localities = append(gt.Localities, galleryLocality{Locality: locality, Trees: ts})
+			gt.Count += len(ts)
+		}
+		sort.Slice(gt.Localities, func(i, j int) bool {
+			a, b := gt.Localities[i].Locality, gt.Localities[j].Locality
+			if (a == "") != (b == "") {
+				return b == ""
+			}
+			return a < b
+		})
+		gts = append(gts, gt)
+	}
+	sort.Slice(gts, func(i, j int) bool {
+		return gts[i].Type < gts[j].Type
+	})
+	return gts
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/fruktkartan/fruktsam/internal/history"
+	"github.com/fruktkartan/fruktsam/internal/images"
+)
+
+// usedImages gives the images that are in use: thumbnails of the current
+// trees, the placeholder, and the images of the history and of the
+// archive pages
+func (rr *reportRun) usedImages(reports []*report) map[string]bool {
+	used := make(map[string]bool)
+	for _, f := range history.PlaceholderFiles() {
+		used[f] = true
+	}
+	for _, img := range rr.trees.Images() {
+		for _, f := range history.ThumbFiles(img) {
+			used[f] = true
+		}
+	}
+	for _, f := range rr.history.ImageFiles() {
+		used[f] = true
+	}
+	for _, r := range reports {
+		if r.archive == nil {
+			continue
+		}
+		for _, f := range r.archive.Images() {
+			used[f] = true
+		}
+	}
+	return used
+}
+
+// gcThumbs removes the images not in use, and the broken ones, from the
+// cache and the dests of the reports
+func (rr *reportRun) gcThumbs(reports []*report) error {
+	used := rr.usedImages(reports)
+
+	dirs := []string{rr.cacheDir}
+	for _, r := range reports {
+		if r.Dest != rr.cacheDir {
+			dirs = append(dirs, r.Dest)
+		}
+	}
+
+	for _, dir := range dirs {
+		res, err := images.GC(images.DirStore{Dir: dir}, history.ImageDir, used)
+		if err != nil {
+			return fmt.Errorf("failed images.GC %s: %w", dir, err)
+		}
+		slog.Info(fmt.Sprintf("Images in %s: kept %s, removed unused %s, removed invalid %s",
+			dir, res.Kept, res.Unused, res.Invalid))
+	}
+
+	return nil
+}
+
+// logImageUsage logs the disk usage of the images in the cache
+func (rr *reportRun) logImageUsage() error {
+	files, err := images.DirStore{Dir: rr.cacheDir}.List(history.ImageDir)
+	if err != nil {
+		return fmt.Errorf("failed List images: %w", err)
+	}
+	var usage images.Usage
+	for _, f := range files {
+		usage.Add(f)
+	}
+	slog.Info(fmt.Sprintf("Images in %s: %s", rr.cacheDir, usage))
+	return nil
+}
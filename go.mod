@@ -3,6 +3,7 @@ module github.com/fruktkartan/fruktsam
 go 1.25.0
 
 require (
+	github.com/BurntSushi/toml v1.6.0
 	github.com/goodsign/monday v1.0.2
 	github.com/google/renameio/v2 v2.0.2
 	github.com/jmoiron/sqlx v1.4.0
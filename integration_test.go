@@ -0,0 +1,378 @@
+//go:build unix
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/fruktkartan/fruktsam/internal/i18n"
+	"github.com/fruktkartan/fruktsam/internal/images"
+	"github.com/fruktkartan/fruktsam/internal/reversecache"
+	"github.com/fruktkartan/fruktsam/internal/util"
+	"github.com/jmoiron/sqlx"
+)
+
+var update = flag.Bool("update", false, "Update the golden files of the integration test")
+
+const (
+	testdataDir = "testdata/integration"
+	goldenDir   = testdataDir + "/golden"
+
+	// stands in for the URL of the image stub, which changes between runs
+	testBucket = "http://images.example"
+)
+
+// Images in the image stub, the others are not found
+var testImages = []string{"a1img", "p2img", "p2img2", "d5img"}
+
+// TestIntegration runs a full generation against a local postgres seeded
+// with testdata/integration, with nominatim and the image bucket stubbed,
+// and compares the pages to the golden files. Run with -update to write
+// them anew. Needs initdb and pg_ctl on PATH, or in the directory PGBIN.
+func TestIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+	dbURL := startPostgres(t)
+
+	db, err := openDB(dbURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, file := range []string{"schema.sql", "seed.sql"} {
+		execFile(t, db, filepath.Join(testdataDir, file))
+	}
+
+	nominatim := httptest.NewServer(nominatimStub(t))
+	defer nominatim.Close()
+	bucket := httptest.NewServer(bucketStub())
+	defer bucket.Close()
+
+	setGlobals(t, nominatim.URL)
+	t.Setenv("DATABASE_URL", dbURL)
+
+	dest := filepath.Join(t.TempDir(), "report")
+	cfg := &config{
+		Images: bucket.URL,
+		Reports: []reportConfig{{
+			Dest:    dest,
+			Month:   "2026-09",
+			Archive: "month",
+			Gallery: true,
+		}},
+	}
+	if err = cfg.check(); err != nil {
+		t.Fatal(err)
+	}
+	imgSrc, err := images.ParseSource(cfg.Images)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = runOnce(context.Background(), cfg, db, imgSrc); err != nil {
+		t.Fatalf("runOnce: %s", err)
+	}
+
+	compareGolden(t, dest, bucket.URL)
+}
+
+// startPostgres initializes and starts a postgres in a temporary directory,
+// stopped when the test ends, and gives the URL of an empty database in
+// it. Skips the test if postgres is not available.
+func startPostgres(t *testing.T) string {
+	t.Helper()
+
+	initdb, pgctl := pgCommand("initdb"), pgCommand("pg_ctl")
+	for _, cmd := range []string{initdb, pgctl} {
+		if _, err := exec.LookPath(cmd); err != nil {
+			t.Skipf("skipping integration test, no postgres: %s", err)
+		}
+	}
+	dataDir, cred := pgDataDir(t)
+	runCmd(t, cred, initdb, "-D", dataDir, "-U", "fruktsam", "-A", "trust", "-E", "UTF8", "--locale=C")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	opts := fmt.Sprintf("-p %d -c listen_addresses=127.0.0.1 -c unix_socket_directories=%s -c timezone=UTC -c fsync=off",
+		port, dataDir)
+	runCmd(t, cred, pgctl, "-D", dataDir, "-l", filepath.Join(dataDir, "postgres.log"), "-o", opts, "-w", "start")
+	t.Cleanup(func() {
+		runCmd(t, cred, pgctl, "-D", dataDir, "-m", "immediate", "-w", "stop")
+	})
+
+	// lib/pq takes sslmode from env, keeping the URL in the form that
+	// getDatabaseName expects
+	t.Setenv("PGSSLMODE", "disable")
+	baseURL := fmt.Sprintf("postgres://fruktsam@127.0.0.1:%d", port)
+	db, err := sqlx.Open("postgres", baseURL+"/postgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err = db.Exec("CREATE DATABASE fruktsam"); err != nil {
+		t.Fatalf("failed create database: %s", err)
+	}
+	return baseURL + "/fruktsam"
+}
+
+func pgCommand(name string) string {
+	if dir := os.Getenv("PGBIN"); dir != "" {
+		return filepath.Join(dir, name)
+	}
+	return name
+}
+
+// pgDataDir makes a temporary directory for the data of postgres, removed
+// when the test ends. As postgres refuses to run as root, it is then run as
+// the user postgres, or else nobody, given by the credential to run it
+// with (nil if not root).
+func pgDataDir(t *testing.T) (string, *syscall.Credential) {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		return t.TempDir(), nil
+	}
+
+	u, err := user.Lookup("postgres")
+	if err != nil {
+		if u, err = user.Lookup("nobody"); err != nil {
+			t.Skipf("skipping integration test, no user to run postgres as: %s", err)
+		}
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Not in t.TempDir, which the user can not get into
+	dir, err := os.MkdirTemp("", "fruktsam-pg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = os.RemoveAll(dir)
+	})
+	if err = os.Chown(dir, int(uid), int(gid)); err != nil {
+		t.Fatal(err)
+	}
+	return dir, &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+}
+
+// runCmd runs a command, as the user of cred if not nil
+func runCmd(t *testing.T, cred *syscall.Credential, name string, args ...string) {
+	t.Helper()
+	cmd := exec.Command(name, args...)
+	if cred != nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: cred}
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("failed %s: %s\n%s", name, err, out)
+	}
+}
+
+func execFile(t *testing.T, db *sqlx.DB, file string) {
+	t.Helper()
+	b, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Exec(string(b)); err != nil {
+		t.Fatalf("failed exec %s: %s", file, err)
+	}
+}
+
+// nominatimStub answers reverse lookups from nominatim.json, keyed by
+// "lat,lon", and like nominatim does for positions it has nothing for.
+func nominatimStub(t *testing.T) http.Handler {
+	b, err := os.ReadFile(filepath.Join(testdataDir, "nominatim.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var answers map[string]json.RawMessage
+	if err = json.Unmarshal(b, &answers); err != nil {
+		t.Fatal(err)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		w.Header().Set("content-type", "application/json")
+		if answer, ok := answers[q.Get("lat")+","+q.Get("lon")]; ok {
+			_, _ = w.Write(answer)
+			return
+		}
+		_, _ = w.Write([]byte(`{"error":"Unable to geocode"}`))
+	})
+}
+
+// bucketStub serves testImages, each a JPEG with a color of its own
+func bucketStub() http.Handler {
+	objects := make(map[string][]byte)
+	for _, name := range testImages {
+		objects["/"+fmt.Sprintf(images.ObjectFmt, name)] = testJPEG(name)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, ok := objects[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("content-type", "image/jpeg")
+		_, _ = w.Write(b)
+	})
+}
+
+func testJPEG(name string) []byte {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	sum := h.Sum32()
+	c := color.RGBA{R: uint8(sum), G: uint8(sum >> 8), B: uint8(sum >> 16), A: 0xff}
+
+	img := image.NewRGBA(image.Rect(0, 0, 400, 300))
+	for y := range 300 {
+		for x := range 400 {
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+// setGlobals sets up the packages like run does, with the time of the run
+// fixed and nominatim at nominatimURL. Restored when the test ends.
+func setGlobals(t *testing.T, nominatimURL string) {
+	t.Helper()
+
+	prevNow, prevURL, prevInterval := timeNow, reversecache.NominatimURL, reversecache.LookupInterval
+	t.Cleanup(func() {
+		timeNow, reversecache.NominatimURL, reversecache.LookupInterval = prevNow, prevURL, prevInterval
+	})
+	timeNow = func() time.Time {
+		return time.Date(2026, 10, 1, 10, 0, 0, 0, time.UTC)
+	}
+	reversecache.NominatimURL = nominatimURL
+	reversecache.LookupInterval = 0
+
+	for _, err := range []error{
+		i18n.Set(i18n.DefaultLang),
+		util.SetLocale(i18n.DefaultLang),
+		util.SetLocation(util.DefaultTimeZone),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !testing.Verbose() {
+		setLogLevel(slog.LevelWarn)
+	}
+}
+
+// compareGolden compares the pages and search index in dest with the
+// golden files, or writes them anew if -update.
+func compareGolden(t *testing.T, dest, bucketURL string) {
+	t.Helper()
+
+	var outputs []string
+	err := filepath.WalkDir(dest, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && (filepath.Ext(path) == ".html" || d.Name() == searchFile) {
+			outputs = append(outputs, path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outputs) == 0 {
+		t.Fatal("no pages generated")
+	}
+
+	goldens := make(map[string]bool)
+	for _, path := range outputs {
+		rel, _ := filepath.Rel(dest, path)
+		golden := filepath.Join(goldenDir, strings.ReplaceAll(filepath.ToSlash(rel), "/", "_")+".golden")
+		goldens[golden] = true
+
+		b, readErr := os.ReadFile(path)
+		if readErr != nil {
+			t.Fatal(readErr)
+		}
+		got := bytes.ReplaceAll(b, []byte(bucketURL), []byte(testBucket))
+
+		if *update {
+			if err = os.MkdirAll(goldenDir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err = os.WriteFile(golden, got, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			t.Logf("wrote %s, check and commit it", golden)
+			continue
+		}
+		want, readErr := os.ReadFile(golden)
+		if os.IsNotExist(readErr) {
+			t.Errorf("%s has no golden file %s, run with -update to write it", rel, golden)
+			continue
+		}
+		if readErr != nil {
+			t.Fatal(readErr)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s differs from %s, run with -update if the change is intended", rel, golden)
+		}
+	}
+
+	// Pages that are no longer generated
+	files, err := filepath.Glob(filepath.Join(goldenDir, "*.golden"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if goldens[file] {
+			continue
+		}
+		if *update {
+			if err = os.Remove(file); err != nil {
+				t.Fatal(err)
+			}
+			t.Logf("removed %s", file)
+			continue
+		}
+		t.Errorf("golden file %s has no page, run with -update to remove it", file)
+	}
+}
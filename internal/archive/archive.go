@@ -0,0 +1,170 @@
+package archive
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/fruktkartan/fruktsam/internal/history"
+	"github.com/fruktkartan/fruktsam/internal/window"
+	"github.com/google/renameio/v2"
+)
+
+const (
+	Dir       = "archive"
+	IndexFile = "index.html"
+	stateFile = "state.json"
+)
+
+// Archive keeps track of the pages of history per period in the archive
+// directory, so that only pages of periods with new history need to be
+// generated.
+type Archive struct {
+	Period window.Period
+	dir    string
+	state  state
+}
+
+type state struct {
+	Period window.Period        `json:"period"`
+	Config string               `json:"config"` // hash of the config the pages were made with
+	Pages  map[string]pageState `json:"pages"`
+}
+
+type pageState struct {
+	history.PeriodStat
+	// Images used on the page, nil if not recorded (by older versions)
+	Images []string `json:"images"`
+}
+
+// Page is a page in the archive, for the index
+type Page struct {
+	history.PeriodStat
+	File string
+}
+
+// Open opens the archive in destDir. The config identifies all but the
+// history that the pages are made from (like filter, templates and
+// language), when it changes all pages are generated again.
+func Open(destDir string, p window.Period, config string) (*Archive, error) {
+	a := Archive{Period: p, dir: filepath.Join(destDir, Dir)}
+	if err := os.MkdirAll(a.dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed MkdirAll: %w", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(a.dir, stateFile))
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		if err = json.Unmarshal(data, &a.state); err != nil {
+			return nil, fmt.Errorf("failed Unmarshal archive state: %w", err)
+		}
+	}
+
+	if a.state.Period != p {
+		if a.state.Period != "" {
+			slog.Info(fmt.Sprintf("Archive: period changed from %s to %s, regenerating all",
+				a.state.Period, p))
+		}
+		a.state = state{Period: p, Config: config}
+	}
+	if a.state.Config != config {
+		if a.state.Config != "" {
+			slog.Info("Archive: report config changed, regenerating all")
+		}
+		a.state = state{Period: p, Config: config}
+	}
+	if a.state.Pages == nil {
+		a.state.Pages = make(map[string]pageState)
+	}
+
+	return &a, nil
+}
+
+// Stale gives the periods that need their page (re)generated. Pages
+// without recorded images are regenerated, so that their images are kept.
+func (a *Archive) Stale(periods []history.PeriodStat) []history.PeriodStat {
+	var stale []history.PeriodStat
+	for _, ps := range periods {
+		if old, ok := a.state.Pages[ps.Key]; ok && old.PeriodStat == ps && old.Images != nil {
+			if _, err := os.Stat(a.PagePath(ps.Key)); err == nil {
+				continue
+			}
+		}
+		stale = append(stale, ps)
+	}
+	return stale
+}
+
+// Span is the window covering all the periods
+func (a *Archive) Span(periods []history.PeriodStat) (window.Window, error) {
+	var span window.Window
+	for _, ps := range periods {
+		w, err := a.Period.Window(ps.Key)
+		if err != nil {
+			return span, err
+		}
+		if span.From.IsZero() || w.From.Before(span.From) {
+			span.From = w.From
+		}
+		if span.To.IsZero() || w.To.After(span.To) {
+			span.To = w.To
+		}
+	}
+	return span, nil
+}
+
+func (a *Archive) PageFile(key string) string {
+	return key + ".html"
+}
+
+func (a *Archive) PagePath(key string) string {
+	return filepath.Join(a.dir, a.PageFile(key))
+}
+
+func (a *Archive) IndexPath() string {
+	return filepath.Join(a.dir, IndexFile)
+}
+
+// Generated records that the page of the period has been written, using
+// the images
+func (a *Archive) Generated(ps history.PeriodStat, images []string) {
+	if images == nil {
+		images = []string{}
+	}
+	a.state.Pages[ps.Key] = pageState{PeriodStat: ps, Images: images}
+}
+
+// Images gives the images used on the pages
+func (a *Archive) Images() []string {
+	var images []string
+	for _, page := range a.state.Pages {
+		images = append(images, page.Images...)
+	}
+	return images
+}
+
+// Pages gives the generated pages, latest first
+func (a *Archive) Pages() []Page {
+	pages := make([]Page, 0, len(a.state.Pages))
+	for key, ps := range a.state.Pages {
+		pages = append(pages, Page{PeriodStat: ps.PeriodStat, File: a.PageFile(key)})
+	}
+	sort.Slice(pages, func(i, j int) bool {
+		return pages[i].Key > pages[j].Key
+	})
+	return pages
+}
+
+func (a *Archive) Save() error {
+	data, err := json.MarshalIndent(a.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return renameio.WriteFile(filepath.Join(a.dir, stateFile), data, 0o644)
+}
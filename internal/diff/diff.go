@@ -0,0 +1,137 @@
+package diff
+
+import (
+	"html"
+	"html/template"
+	"strings"
+	"unicode"
+
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// Words diffs before and after word by word, cleaned up to be readable
+func Words(before, after string) []diffmatchpatch.Diff {
+	// Diff the words as runes, one per distinct word, like
+	// DiffLinesToRunes does for lines
+	var words []string
+	index := make(map[string]rune)
+	toRunes := func(s string) []rune {
+		var runes []rune
+		for _, w := range split(s) {
+			r, ok := index[w]
+			if !ok {
+				words = append(words, w)
+				r = rune(len(words))
+				index[w] = r
+			}
+			runes = append(runes, r)
+		}
+		return runes
+	}
+	beforeRunes, afterRunes := toRunes(before), toRunes(after)
+
+	dmp := diffmatchpatch.New()
+	diffs := dmp.DiffMainRunes(beforeRunes, afterRunes, false)
+	for idx := range diffs {
+		var b strings.Builder
+		for _, r := range diffs[idx].Text {
+			b.WriteString(words[r-1])
+		}
+		diffs[idx].Text = b.String()
+	}
+	return dmp.DiffCleanupSemantic(diffs)
+}
+
+// split splits s into words, runs of space, and single other characters
+func split(s string) []string {
+	var parts []string
+	start := 0
+	runes := []rune(s)
+	for i := 1; i <= len(runes); i++ {
+		if i < len(runes) && class(runes[i]) == class(runes[start]) && class(runes[i]) != 0 {
+			continue
+		}
+		parts = append(parts, string(runes[start:i]))
+		start = i
+	}
+	return parts
+}
+
+func class(r rune) int {
+	switch {
+	case unicode.IsLetter(r) || unicode.IsDigit(r):
+		return 1
+	case unicode.IsSpace(r):
+		return 2
+	}
+	return 0
+}
+
+// HTML renders the changes from before to after as an HTML fragment, with
+// removed words in <del> and added words in <ins>. All the text is
+// escaped, so the fragment is safe to use in a page as is.
+func HTML(before, after string) template.HTML {
+	var b strings.Builder
+	for _, d := range Words(before, after) {
+		text := escape(d.Text)
+		switch d.Type {
+		case diffmatchpatch.DiffInsert:
+			b.WriteString("<ins>" + text + "</ins>")
+		case diffmatchpatch.DiffDelete:
+			b.WriteString("<del>" + text + "</del>")
+		case diffmatchpatch.DiffEqual:
+			b.WriteString(text)
+		}
+	}
+
+	// Escaped above
+	return template.HTML(b.String())
+}
+
+// Text renders the changes from before to after as plain text, with
+// removed words like [-this-] and added words like {+this+}.
+func Text(before, after string) string {
+	var b strings.Builder
+	for _, d := range Words(before, after) {
+		switch d.Type {
+		case diffmatchpatch.DiffInsert:
+			b.WriteString("{+" + d.Text + "+}")
+		case diffmatchpatch.DiffDelete:
+			b.WriteString("[-" + d.Text + "-]")
+		case diffmatchpatch.DiffEqual:
+			b.WriteString(d.Text)
+		}
+	}
+	return b.String()
+}
+
+// ReplaceHTML renders a value replaced as a whole, like HTML
+func ReplaceHTML(before, after string) template.HTML {
+	var parts []string
+	if before != "" {
+		parts = append(parts, "<del>"+escape(before)+"</del>")
+	}
+	if after != "" {
+		parts = append(parts, "<ins>"+escape(after)+"</ins>")
+	}
+
+	// Escaped above
+	return template.HTML(strings.Join(parts, " → "))
+}
+
+// ReplaceText renders a value replaced as a whole, like Text
+func ReplaceText(before, after string) string {
+	var parts []string
+	if before != "" {
+		parts = append(parts, "[-"+before+"-]")
+	}
+	if after != "" {
+		parts = append(parts, "{+"+after+"+}")
+	}
+	return strings.Join(parts, " → ")
+}
+
+// escape escapes text for HTML, keeping line breaks
+func escape(text string) string {
+	return strings.ReplaceAll(html.EscapeString(text), "\n", "<br>")
+}
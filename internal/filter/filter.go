@@ -0,0 +1,190 @@
+package filter
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/fruktkartan/fruktsam/internal/i18n"
+	"github.com/fruktkartan/fruktsam/internal/taxonomy"
+	"github.com/fruktkartan/fruktsam/internal/types"
+)
+
+// Places finds out where positions are
+type Places interface {
+	Municipality(p types.Pos) string
+}
+
+// Filter restricts a report to some trees and changes. Empty fields do not
+// restrict anything.
+type Filter struct {
+	// Types are raw types, species or categories in the taxonomy
+	Types          []string
+	By             []string
+	Ops            []string // DELETE, INSERT, UPDATE
+	BBox           *BBox
+	Municipalities []string
+
+	Taxonomy *taxonomy.Taxonomy
+	Places   Places // needed for Municipalities
+}
+
+type BBox struct {
+	MinLat, MinLon, MaxLat, MaxLon float64
+}
+
+// ParseBBox parses a bounding box given like minlat,minlon,maxlat,maxlon
+func ParseBBox(s string) (*BBox, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("bbox %q is not like minlat,minlon,maxlat,maxlon", s)
+	}
+	var v [4]float64
+	for i, part := range parts {
+		var err error
+		if v[i], err = strconv.ParseFloat(strings.TrimSpace(part), 64); err != nil {
+			return nil, fmt.Errorf("bbox %q: %w", s, err)
+		}
+	}
+	b := BBox{MinLat: v[0], MinLon: v[1], MaxLat: v[2], MaxLon: v[3]}
+	if b.MinLat > b.MaxLat || b.MinLon > b.MaxLon {
+		return nil, fmt.Errorf("bbox %q: min is larger than max", s)
+	}
+	return &b, nil
+}
+
+func (b BBox) Contains(p types.Pos) bool {
+	return p.Lat >= b.MinLat && p.Lat <= b.MaxLat && p.Lon >= b.MinLon && p.Lon <= b.MaxLon
+}
+
+// ParseOps parses comma separated ops, like insert,delete
+func ParseOps(s string) ([]string, error) {
+	var ops []string
+	for _, op := range List(s) {
+		op = strings.ToUpper(op)
+		switch op {
+		case "DELETE", "INSERT", "UPDATE":
+			ops = append(ops, op)
+		default:
+			return nil, fmt.Errorf("op %q is not insert, delete or update", op)
+		}
+	}
+	return ops, nil
+}
+
+// List splits a comma separated list, dropping empty items
+func List(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Subject is a tree, or one side of a change to a tree, to match the
+// filter against.
+type Subject struct {
+	Op     string // empty for current trees
+	Type   string
+	By     string
+	Pos    types.Pos
+	HasPos bool
+}
+
+func (f *Filter) Empty() bool {
+	return f == nil || (len(f.Types) == 0 && len(f.By) == 0 && len(f.Ops) == 0 &&
+		f.BBox == nil && len(f.Municipalities) == 0)
+}
+
+// Match tells if a subject passes the filter. Ops are only checked for
+// subjects that have an op.
+func (f *Filter) Match(s Subject) bool {
+	if f.Empty() {
+		return true
+	}
+	if len(f.Ops) > 0 && s.Op != "" && !slices.Contains(f.Ops, s.Op) {
+		return false
+	}
+	if len(f.Types) > 0 && !f.matchType(s.Type) {
+		return false
+	}
+	if len(f.By) > 0 && !containsFold(f.By, s.By) {
+		return false
+	}
+	if f.BBox != nil && (!s.HasPos || !f.BBox.Contains(s.Pos)) {
+		return false
+	}
+	// Last, as it may need an address lookup
+	if len(f.Municipalities) > 0 {
+		if !s.HasPos || f.Places == nil {
+			return false
+		}
+		muni := trimKommun(f.Places.Municipality(s.Pos))
+		if !slices.ContainsFunc(f.Municipalities, func(m string) bool {
+			return strings.EqualFold(trimKommun(m), muni)
+		}) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *Filter) matchType(typ string) bool {
+	keys := []string{taxonomy.Normalize(typ)}
+	if sp, ok := f.Taxonomy.Lookup(typ); ok {
+		keys = append(keys, taxonomy.Normalize(sp.Name), taxonomy.Normalize(sp.Category))
+	}
+	for _, t := range f.Types {
+		if slices.Contains(keys, taxonomy.Normalize(t)) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(list []string, s string) bool {
+	s = strings.TrimSpace(s)
+	for _, item := range list {
+		if strings.EqualFold(strings.TrimSpace(item), s) {
+			return true
+		}
+	}
+	return false
+}
+
+// trimKommun makes "Malmö kommun" match "Malmö"
+func trimKommun(s string) string {
+	return strings.TrimSuffix(strings.TrimSpace(s), " kommun")
+}
+
+// String describes the filter for the report
+func (f *Filter) String() string {
+	if f.Empty() {
+		return ""
+	}
+	var parts []string
+	if len(f.Types) > 0 {
+		parts = append(parts, i18n.T("filter.types", strings.Join(f.Types, ", ")))
+	}
+	if len(f.By) > 0 {
+		parts = append(parts, i18n.T("filter.by", strings.Join(f.By, ", ")))
+	}
+	if len(f.Ops) > 0 {
+		var ops []string
+		for _, op := range f.Ops {
+			ops = append(ops, i18n.T("op."+op))
+		}
+		parts = append(parts, i18n.T("filter.ops", strings.Join(ops, ", ")))
+	}
+	if f.BBox != nil {
+		parts = append(parts, i18n.T("filter.bbox", fmt.Sprintf("%g,%g–%g,%g",
+			f.BBox.MinLat, f.BBox.MinLon, f.BBox.MaxLat, f.BBox.MaxLon)))
+	}
+	if len(f.Municipalities) > 0 {
+		parts = append(parts, i18n.T("filter.municipalities", strings.Join(f.Municipalities, ", ")))
+	}
+	return strings.Join(parts, "; ")
+}
@@ -0,0 +1,77 @@
+package flagtypes
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+//go:embed flagtypes.json
+var defaultFlagTypes []byte
+
+type FlagTypes struct {
+	Types  []FlagType `json:"types"`
+	byType map[string]*FlagType
+}
+
+type FlagType struct {
+	Type        string `json:"type"`
+	Label       string `json:"label"`
+	Description string `json:"description"`
+}
+
+// Load reads flag types from a JSON file, or the built-in default if file
+// is empty.
+func Load(file string) (*FlagTypes, error) {
+	data := defaultFlagTypes
+	if file != "" {
+		var err error
+		if data, err = os.ReadFile(file); err != nil {
+			return nil, fmt.Errorf("failed ReadFile: %w", err)
+		}
+	}
+
+	var ft FlagTypes
+	if err := json.Unmarshal(data, &ft); err != nil {
+		return nil, fmt.Errorf("failed Unmarshal flag types: %w", err)
+	}
+
+	ft.byType = make(map[string]*FlagType)
+	for idx := range ft.Types {
+		t := &ft.Types[idx]
+		if t.Type == "" {
+			return nil, fmt.Errorf("flag types: entry %d has no type", idx)
+		}
+		if _, ok := ft.byType[t.Type]; ok {
+			return nil, fmt.Errorf("flag types: type %q given twice", t.Type)
+		}
+		ft.byType[t.Type] = t
+	}
+
+	return &ft, nil
+}
+
+// Label gives the configured label of a flag type, or the type itself if
+// it is not configured. Safe to call on nil FlagTypes.
+func (ft *FlagTypes) Label(typ string) string {
+	if ft == nil {
+		return typ
+	}
+	if t, ok := ft.byType[typ]; ok && t.Label != "" {
+		return t.Label
+	}
+	return typ
+}
+
+// Labels maps each configured flag type to its label.
+func (ft *FlagTypes) Labels() map[string]string {
+	labels := make(map[string]string)
+	if ft == nil {
+		return labels
+	}
+	for _, t := range ft.Types {
+		labels[t.Type] = ft.Label(t.Type)
+	}
+	return labels
+}
@@ -0,0 +1,96 @@
+package history
+
+import (
+	"fmt"
+	"html/template"
+	"slices"
+	"strings"
+
+	"github.com/fruktkartan/fruktsam/internal/diff"
+	"github.com/fruktkartan/fruktsam/internal/i18n"
+)
+
+// Fields of a tree that can change in an update
+const (
+	FieldType = "type"
+	FieldDesc = "desc"
+	FieldImg  = "img"
+	FieldPos  = "pos"
+	FieldBy   = "by"
+	FieldAt   = "at"
+)
+
+// FieldChange is the change of one field of a tree in an update
+type FieldChange struct {
+	Field         string
+	Before, After string
+}
+
+// Label is the name of the field, in the language of the report
+func (fc FieldChange) Label() string {
+	return i18n.T("field." + fc.Field)
+}
+
+// HTML renders the change, word by word for text fields. Safe to use in a
+// page as is.
+func (fc FieldChange) HTML() template.HTML {
+	if fc.Field == FieldDesc {
+		return diff.HTML(fc.Before, fc.After)
+	}
+	return diff.ReplaceHTML(fc.Before, fc.After)
+}
+
+// Text renders the change as plain text
+func (fc FieldChange) Text() string {
+	if fc.Field == FieldDesc {
+		return diff.Text(fc.Before, fc.After)
+	}
+	return diff.ReplaceText(fc.Before, fc.After)
+}
+
+// fieldChanges gives the changed fields of an update
+func (e *Entry) fieldChanges() []FieldChange {
+	var changes []FieldChange
+	add := func(field, before, after string) {
+		if before != after {
+			changes = append(changes, FieldChange{Field: field, Before: before, After: after})
+		}
+	}
+	add(FieldType, e.Type.String(), e.TypeNew.String())
+	add(FieldDesc, e.Desc.String(), e.DescNew.String())
+	add(FieldImg, e.Img.String(), e.ImgNew.String())
+	add(FieldPos, formatPos(e.Lat.Valid, e.Lat.Float64, e.Lon.Float64),
+		formatPos(e.LatNew.Valid, e.LatNew.Float64, e.LonNew.Float64))
+	add(FieldBy, e.By.String(), e.ByNew.String())
+	add(FieldAt, e.At.String(), e.AtNew.String())
+	return changes
+}
+
+func formatPos(valid bool, lat, lon float64) string {
+	if !valid {
+		return ""
+	}
+	return fmt.Sprintf("%.6f,%.6f", lat, lon)
+}
+
+// ChangesExcept gives the changes of an update, except of the fields
+// that are shown otherwise.
+func (e Entry) ChangesExcept(fields ...string) []FieldChange {
+	var changes []FieldChange
+	for _, fc := range e.Changes {
+		if !slices.Contains(fields, fc.Field) {
+			changes = append(changes, fc)
+		}
+	}
+	return changes
+}
+
+// ChangesText renders the changes of an update as plain text, a line per
+// changed field.
+func (e Entry) ChangesText() string {
+	var lines []string
+	for _, fc := range e.Changes {
+		lines = append(lines, fc.Label()+": "+fc.Text())
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,103 @@
+package history
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math/bits"
+	"path/filepath"
+
+	"github.com/fruktkartan/fruktsam/internal/runreport"
+	"golang.org/x/image/draw"
+)
+
+const (
+	compareFileFmt = "compare_%s_%s.jpg"
+	compareGap     = 4
+
+	// Hash distances (of 64 bits) for verdicts on a changed image
+	sameMaxDistance      = 5
+	differentMinDistance = 25
+)
+
+// Verdicts on a changed image
+const (
+	VerdictSame      = "same"      // nearly identical, probably a re-upload
+	VerdictDifferent = "different" // wildly different, maybe of another tree
+)
+
+// ImageCompare compares the image of a tree before and after an update
+type ImageCompare struct {
+	File       string // side by side image, relative to destDir
+	Distance   int    // between perceptual hashes, 0-64
+	Similarity int    // percent
+	Verdict    string // VerdictSame, VerdictDifferent or empty
+}
+
+// compareImages compares the thumbs of two images, creating a side by side
+// image of them. Gives nil if a thumb is missing.
+func (h *History) compareImages(before, after string) *ImageCompare {
+	a, err := h.getImage(imageFilePath(before))
+	if err != nil {
+		runreport.Error(runreport.StageImages, fmt.Sprintf("failed compare images: %s", err))
+		return nil
+	}
+	b, err := h.getImage(imageFilePath(after))
+	if err != nil {
+		runreport.Error(runreport.StageImages, fmt.Sprintf("failed compare images: %s", err))
+		return nil
+	}
+
+	distance := bits.OnesCount64(dHash(a) ^ dHash(b))
+	ic := ImageCompare{
+		File:       filepath.Join(ImageDir, fmt.Sprintf(compareFileFmt, before, after)),
+		Distance:   distance,
+		Similarity: 100 * (64 - distance) / 64,
+	}
+	switch {
+	case distance <= sameMaxDistance:
+		ic.Verdict = VerdictSame
+	case distance >= differentMinDistance:
+		ic.Verdict = VerdictDifferent
+	}
+
+	if !h.Thumbs.Has(ic.File) {
+		if err = h.putImage(ic.File, sideBySide(a, b)); err != nil {
+			runreport.Error(runreport.StageImages, fmt.Sprintf("failed side by side image %s: %s", ic.File, err))
+			ic.File = ""
+		}
+	}
+
+	return &ic
+}
+
+// dHash is a difference hash of the image: whether brightness increases
+// between horizontally adjacent pixels, on a grayscale 9x8 version.
+func dHash(img image.Image) uint64 {
+	small := image.NewGray(image.Rect(0, 0, 9, 8))
+	draw.BiLinear.Scale(small, small.Bounds(), img, img.Bounds(), draw.Src, nil)
+
+	var hash uint64
+	for y := range 8 {
+		for x := range 8 {
+			hash <<= 1
+			if small.GrayAt(x, y).Y < small.GrayAt(x+1, y).Y {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// sideBySide puts the images next to each other, top aligned, on white
+func sideBySide(a, b image.Image) image.Image {
+	ab, bb := a.Bounds(), b.Bounds()
+	width := ab.Dx() + compareGap + bb.Dx()
+	height := max(ab.Dy(), bb.Dy())
+
+	out := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(out, out.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(out, image.Rect(0, 0, ab.Dx(), ab.Dy()), a, ab.Min, draw.Src)
+	draw.Draw(out, image.Rect(ab.Dx()+compareGap, 0, width, bb.Dy()), b, bb.Min, draw.Src)
+	return out
+}
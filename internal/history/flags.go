@@ -0,0 +1,298 @@
+package history
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/fruktkartan/fruktsam/internal/types"
+	"github.com/fruktkartan/fruktsam/internal/util"
+	"github.com/fruktkartan/fruktsam/internal/window"
+	"github.com/jmoiron/sqlx"
+)
+
+// How a flag was resolved
+const (
+	ResolutionNone      = ""
+	ResolutionDeleted   = "deleted"   // the flagged tree was deleted
+	ResolutionDismissed = "dismissed" // only the flag was deleted
+)
+
+// A tree delete this close to a flag delete is taken to be what removed
+// the flag (flags are deleted by cascade along with their tree).
+const treeDeleteSlack = time.Minute
+
+// flagRow is one row of history for tab='flags'
+type flagRow struct {
+	ChangeID  int
+	ChangeAt  types.NullTime
+	ChangeOp  string
+	TreeKey   types.NullStringTrimmed
+	Type      types.NullStringTrimmed
+	Reason    types.NullStringTrimmed
+	By        types.NullString
+	FlaggedAt types.NullTime
+}
+
+// Flag is the lifecycle of one flag on a tree, from raised to resolved.
+type Flag struct {
+	TreeKey types.NullStringTrimmed
+	Type    types.NullStringTrimmed
+	Label   string // configured label of Type
+	Reason  types.NullStringTrimmed
+	By      types.NullString
+
+	RaisedAt   types.NullTime
+	ResolvedAt types.NullTime
+	Resolution string
+
+	RaisedInWindow, ResolvedInWindow bool
+}
+
+func (f *Flag) setInWindow(w window.Window) {
+	f.RaisedInWindow = f.RaisedAt.Valid && w.Contains(f.RaisedAt.Time)
+	f.ResolvedInWindow = f.ResolvedAt.Valid && w.Contains(f.ResolvedAt.Time)
+}
+
+func (f Flag) Open() bool {
+	return f.Resolution == ResolutionNone
+}
+
+func (f Flag) TimeToResolution() time.Duration {
+	if f.Open() || !f.RaisedAt.Valid || !f.ResolvedAt.Valid {
+		return 0
+	}
+	return f.ResolvedAt.Time.Sub(f.RaisedAt.Time)
+}
+
+func (f Flag) TimeToResolutionStr() string {
+	if f.TimeToResolution() == 0 {
+		return ""
+	}
+	return util.FormatDuration(f.TimeToResolution())
+}
+
+// FlagStats summarizes moderation of flags during the history window.
+type FlagStats struct {
+	Type, Label string // empty if for all types
+
+	Raised, Deleted, Dismissed, Open int
+	MedianResolution                 time.Duration
+	MeanResolution                   time.Duration
+	MaxResolution                    time.Duration
+}
+
+func (fs FlagStats) Resolved() int {
+	return fs.Deleted + fs.Dismissed
+}
+
+func (fs FlagStats) MedianResolutionStr() string {
+	return util.FormatDuration(fs.MedianResolution)
+}
+
+func (fs FlagStats) MeanResolutionStr() string {
+	return util.FormatDuration(fs.MeanResolution)
+}
+
+func (fs FlagStats) MaxResolutionStr() string {
+	return util.FormatDuration(fs.MaxResolution)
+}
+
+func flagsFromDB(ctx context.Context, db sqlx.QueryerContext) ([]flagRow, error) {
+	// All of the flag history is needed, to find when flags that are
+	// resolved during the window were raised
+	query := `SELECT id AS changeid
+                   , at AS changeat
+                   , op AS changeop
+                   , COALESCE(new_json, old_json)->>'tree'                    AS treekey
+                   , COALESCE(new_json, old_json)->>'flag'                    AS type
+                   , COALESCE(new_json, old_json)->>'reason'                  AS reason
+                   , COALESCE(new_json, old_json)->>'flagged_by'              AS by
+                   , (COALESCE(new_json, old_json)->>'flagged_at')::timestamp AS flaggedat
+                FROM history
+               WHERE tab='flags'
+            ORDER BY at, id`
+
+	var rows []flagRow
+	if err := sqlx.SelectContext(ctx, db, &rows, query); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// prepareFlags pairs up the raising and deleting of flags into lifecycles.
+// Must be run after the tree entries are loaded, since it looks for tree
+// deletes to tell how a flag was resolved.
+func (h *History) prepareFlags() {
+	treeDeletes := make(map[string][]time.Time)
+	for idx := range h.entries {
+		he := &h.entries[idx]
+		if he.ChangeOp == "DELETE" && he.ChangeAt.Valid {
+			treeDeletes[he.Key.String()] = append(treeDeletes[he.Key.String()], he.ChangeAt.Time)
+		}
+	}
+	deletedWithTree := func(key string, at time.Time) bool {
+		for _, t := range treeDeletes[key] {
+			d := t.Sub(at)
+			if d > -treeDeleteSlack && d < treeDeleteSlack {
+				return true
+			}
+		}
+		return false
+	}
+
+	type flagID struct{ tree, typ string }
+	open := make(map[flagID]*Flag)
+	var flags []*Flag
+
+	for _, row := range h.flagRows {
+		id := flagID{row.TreeKey.String(), row.Type.String()}
+		switch row.ChangeOp {
+		case "INSERT":
+			f := &Flag{
+				TreeKey:  row.TreeKey,
+				Type:     row.Type,
+				Reason:   row.Reason,
+				By:       row.By,
+				RaisedAt: row.ChangeAt,
+			}
+			open[id] = f
+			flags = append(flags, f)
+		case "UPDATE":
+			if f, ok := open[id]; ok {
+				f.Reason = row.Reason
+				f.By = row.By
+			}
+		case "DELETE":
+			f, ok := open[id]
+			if !ok {
+				// Raised before history was recorded
+				f = &Flag{
+					TreeKey:  row.TreeKey,
+					Type:     row.Type,
+					Reason:   row.Reason,
+					By:       row.By,
+					RaisedAt: row.FlaggedAt,
+				}
+				flags = append(flags, f)
+			}
+			delete(open, id)
+			f.ResolvedAt = row.ChangeAt
+			f.Resolution = ResolutionDismissed
+			if row.ChangeAt.Valid && deletedWithTree(row.TreeKey.String(), row.ChangeAt.Time) {
+				f.Resolution = ResolutionDeleted
+			}
+		}
+	}
+
+	h.flags = make([]Flag, 0, len(flags))
+	for _, f := range flags {
+		f.Label = h.FlagTypes.Label(f.Type.String())
+		f.setInWindow(h.Window)
+		h.flags = append(h.flags, *f)
+	}
+}
+
+// Flags returns the flags that were raised or resolved during the window,
+// latest first.
+func (h *History) Flags() []Flag {
+	var flags []Flag
+	for _, f := range h.flags {
+		if f.RaisedInWindow || f.ResolvedInWindow {
+			flags = append(flags, f)
+		}
+	}
+	sort.SliceStable(flags, func(i, j int) bool {
+		return lastFlagEvent(flags[i]).After(lastFlagEvent(flags[j]))
+	})
+	return flags
+}
+
+func lastFlagEvent(f Flag) time.Time {
+	if f.ResolvedAt.Valid {
+		return f.ResolvedAt.Time
+	}
+	return f.RaisedAt.Time
+}
+
+// FlagStats summarizes flags of all types.
+func (h *History) FlagStats() FlagStats {
+	return flagStats(h.flags)
+}
+
+// FlagTypeStats summarizes flags per type. Configured types come first, in
+// configured order, then any other types found in the history.
+func (h *History) FlagTypeStats() []FlagStats {
+	byType := make(map[string][]Flag)
+	for _, f := range h.flags {
+		byType[f.Type.String()] = append(byType[f.Type.String()], f)
+	}
+
+	var order []string
+	if h.FlagTypes != nil {
+		for _, t := range h.FlagTypes.Types {
+			order = append(order, t.Type)
+		}
+	}
+	var others []string
+	for typ := range byType {
+		if !slices.Contains(order, typ) {
+			others = append(others, typ)
+		}
+	}
+	sort.Strings(others)
+	order = append(order, others...)
+
+	stats := make([]FlagStats, 0, len(order))
+	for _, typ := range order {
+		fs := flagStats(byType[typ])
+		fs.Type = typ
+		fs.Label = h.FlagTypes.Label(typ)
+		stats = append(stats, fs)
+	}
+	return stats
+}
+
+func flagStats(flags []Flag) FlagStats {
+	var fs FlagStats
+	var durations []time.Duration
+
+	for _, f := range flags {
+		if f.Open() {
+			fs.Open++
+		}
+		if f.RaisedInWindow {
+			fs.Raised++
+		}
+		if !f.ResolvedInWindow {
+			continue
+		}
+		switch f.Resolution {
+		case ResolutionDeleted:
+			fs.Deleted++
+		case ResolutionDismissed:
+			fs.Dismissed++
+		}
+		if d := f.TimeToResolution(); d > 0 {
+			durations = append(durations, d)
+		}
+	}
+
+	if len(durations) == 0 {
+		return fs
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	var sum time.Duration
+	for _, d := range durations {
+		sum += d
+	}
+	fs.MeanResolution = sum / time.Duration(len(durations))
+	fs.MedianResolution = durations[len(durations)/2]
+	if len(durations)%2 == 0 {
+		fs.MedianResolution = (durations[len(durations)/2-1] + durations[len(durations)/2]) / 2
+	}
+	fs.MaxResolution = durations[len(durations)-1]
+
+	return fs
+}
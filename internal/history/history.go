@@ -4,51 +4,56 @@ import (
 	"bytes"
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
 	"image"
 	"image/jpeg"
-	"io"
+	"io/fs"
 	"log/slog"
-	"net/http"
 	"os"
-	"path/filepath"
 	"sort"
 	"time"
 
+	"github.com/fruktkartan/fruktsam/internal/diff"
+	"github.com/fruktkartan/fruktsam/internal/filter"
+	"github.com/fruktkartan/fruktsam/internal/flagtypes"
+	"github.com/fruktkartan/fruktsam/internal/images"
+	"github.com/fruktkartan/fruktsam/internal/metrics"
 	"github.com/fruktkartan/fruktsam/internal/reversecache"
+	"github.com/fruktkartan/fruktsam/internal/runreport"
+	"github.com/fruktkartan/fruktsam/internal/taxonomy"
 	"github.com/fruktkartan/fruktsam/internal/types"
+	"github.com/fruktkartan/fruktsam/internal/window"
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq" // for sqlx
-	"github.com/sergi/go-diff/diffmatchpatch"
-	"golang.org/x/image/draw"
-)
-
-const (
-	ImageURLBase    = "https://fruktkartan-thumbs.s3.eu-north-1.amazonaws.com"
-	ImageURLPathFmt = "/%s_1200.jpg"
 )
 
 type History struct {
-	SinceDays                 int
+	Window                    window.Window
+	Taxonomy                  *taxonomy.Taxonomy         // for grouping types in stats, may be nil
+	FlagTypes                 *flagtypes.FlagTypes       // for labeling flags, may be nil
+	ReverseCache              *reversecache.ReverseCache // opened in FromDB if nil
+	CompareImages             bool                       // of updates, see ImageCompare
+	Images                    images.Source              // default the fruktkartan bucket
+	Thumbs                    images.ThumbStore          // default destDir
 	destDir                   string
-	reverseCache              *reversecache.ReverseCache
+	imageFailures             map[string]string // see CreateImageThumb
 	entries                   []Entry
-	deletedFlags              []deletedFlag
+	flagRows                  []flagRow
+	flags                     []Flag
+	tableRows                 []tableRow
+	tableChanges              map[string][]TableChange
 	Deletes, Inserts, Updates int
 }
 
-type deletedFlag struct {
-	TreeKey types.NullStringTrimmed
-	Type    types.NullStringTrimmed
-	Reason  types.NullStringTrimmed
-}
-
 type Entry struct {
 	ChangeID int
 	ChangeAt types.NullTime
 	ChangeOp string
 
-	DeleteReasons []string
+	// Historic flags on a deleted tree
+	DeleteFlags []Flag
 
 	Key      types.NullStringTrimmed
 	Type     types.NullStringTrimmed
@@ -66,48 +71,67 @@ type Entry struct {
 	AtNew          types.NullTime
 	LatNew, LonNew sql.NullFloat64
 
-	Address, AddressNew string
-	Pos, PosNew         types.Pos
-	DescDiff            string
-	UpdateIsEmpty       bool
+	Address, AddressNew   string
+	Locality, LocalityNew string
+	Pos, PosNew           types.Pos
+	DescDiff              template.HTML // escaped
+	Changes               []FieldChange // of an update
+	ImgCompare            *ImageCompare // of an update, if compared
+	ImgError, ImgErrorNew string        // why the image could not be processed
+	imgURL, imgURLNew     string
+	UpdateIsEmpty         bool
 }
 
 func (e Entry) ImgURL() string {
-	img := e.Img.String()
-	if img == "" {
-		return ""
-	}
-	return ImageURLBase + fmt.Sprintf(ImageURLPathFmt, img)
+	return e.imgURL
 }
 
 func (e Entry) ImgURLNew() string {
-	img := e.ImgNew.String()
-	if img == "" {
-		return ""
-	}
-	return ImageURLBase + fmt.Sprintf(ImageURLPathFmt, img)
+	return e.imgURLNew
+}
+
+func (e Entry) thumb() Thumb {
+	return Thumb{Name: e.Img.String(), Error: e.ImgError}
+}
+
+func (e Entry) thumbNew() Thumb {
+	return Thumb{Name: e.ImgNew.String(), Error: e.ImgErrorNew}
 }
 
 func (e Entry) ImgFile() string {
-	img := e.Img.String()
-	if img == "" {
-		return ""
-	}
-	return imageFilePath(img)
+	return e.thumb().File()
 }
 
 func (e Entry) ImgFileNew() string {
-	img := e.ImgNew.String()
-	if img == "" {
-		return ""
-	}
-	return imageFilePath(img)
+	return e.thumbNew().File()
+}
+
+// ImgSrcset gives the thumbnails for an img srcset, prefixed by base
+func (e Entry) ImgSrcset(base string) string {
+	return e.thumb().Srcset(base)
+}
+
+func (e Entry) ImgSrcsetNew(base string) string {
+	return e.thumbNew().Srcset(base)
 }
 
 func (h *History) Count() int {
 	return len(h.entries)
 }
 
+// ImageFiles gives the thumbnails of the entries, relative to destDir
+func (h *History) ImageFiles() []string {
+	var files []string
+	for _, e := range h.entries {
+		files = append(files, e.thumb().Files()...)
+		files = append(files, e.thumbNew().Files()...)
+		if e.ImgCompare != nil && e.ImgCompare.File != "" {
+			files = append(files, e.ImgCompare.File)
+		}
+	}
+	return files
+}
+
 func (h *History) Entries() []Entry {
 	return h.entries
 }
@@ -121,22 +145,62 @@ func (h *History) Net() string {
 	return fmt.Sprintf("%s%d", plus, net)
 }
 
-func (h *History) FromDB(sinceDays int, destDir string) error {
-	if len(h.entries) > 0 {
-		return fmt.Errorf("not empty, refusing to fill from db")
-	}
+// TypeStat is the number of changes in the history for one type (at some
+// taxonomy level).
+type TypeStat struct {
+	Type                      string
+	Deletes, Inserts, Updates int
+}
 
-	if h.reverseCache == nil {
-		var err error
-		h.reverseCache, err = reversecache.NewReverseCache(destDir)
-		if err != nil {
-			return err
+// SpeciesStats counts changes per canonical species in the taxonomy.
+func (h *History) SpeciesStats() []TypeStat {
+	return h.StatsBy(taxonomy.LevelSpecies)
+}
+
+func (h *History) StatsBy(level taxonomy.Level) []TypeStat {
+	stats := make(map[string]*TypeStat)
+	for idx := range h.entries {
+		he := &h.entries[idx]
+		typ := he.TypeNew.String()
+		if he.ChangeOp == "DELETE" {
+			typ = he.Type.String()
+		}
+		key := h.Taxonomy.Key(typ, level)
+		st, ok := stats[key]
+		if !ok {
+			st = &TypeStat{Type: key}
+			stats[key] = st
+		}
+		switch he.ChangeOp {
+		case "DELETE":
+			st.Deletes++
+		case "INSERT":
+			st.Inserts++
+		case "UPDATE":
+			st.Updates++
 		}
 	}
 
-	db, err := sqlx.Connect("postgres", os.Getenv("DATABASE_URL"))
-	if err != nil {
-		return fmt.Errorf("failed Connect: %w", err)
+	typeStats := make([]TypeStat, 0, len(stats))
+	for _, st := range stats {
+		typeStats = append(typeStats, *st)
+	}
+	sort.Slice(typeStats, func(i, j int) bool {
+		ti := typeStats[i].Deletes + typeStats[i].Inserts + typeStats[i].Updates
+		tj := typeStats[j].Deletes + typeStats[j].Inserts + typeStats[j].Updates
+		if ti != tj {
+			return ti > tj
+		}
+		return typeStats[i].Type < typeStats[j].Type
+	})
+	return typeStats
+}
+
+// FromDB reads the history during w, with db like a transaction shared
+// with the reading of the trees. Then Prepare is to be called.
+func (h *History) FromDB(ctx context.Context, db sqlx.QueryerContext, w window.Window) error {
+	if len(h.entries) > 0 {
+		return fmt.Errorf("not empty, refusing to fill from db")
 	}
 
 	query := `SELECT id AS changeid
@@ -159,29 +223,37 @@ func (h *History) FromDB(sinceDays int, destDir string) error {
                    , new_json#>>'{point,coordinates,1}' AS latnew
                    , new_json#>>'{point,coordinates,0}' AS lonnew
                 FROM history
-               WHERE (tab='trees')`
-	if sinceDays > 0 {
-		query += fmt.Sprintf(" AND (at > (CURRENT_DATE - INTERVAL '%d days'))", sinceDays)
-	}
-	if err := db.Select(&h.entries, query); err != nil {
+               WHERE (tab='trees') AND ` + window.Cond
+	if err := sqlx.SelectContext(ctx, db, &h.entries, query, w.Args()...); err != nil {
 		return fmt.Errorf("failed Select trees: %w", err)
 	}
 
-	// Get all flags which have been deleted (though we currently only
-	// have flag type "delete")
-	query2 := `SELECT old_json->>'tree' AS treekey
-                    , old_json->>'flag' AS type
-                    , old_json->>'reason' AS reason
-                 FROM history
-                WHERE tab='flags'
-             ORDER BY at`
-	if err := db.Select(&h.deletedFlags, query2); err != nil {
+	var err error
+	if h.flagRows, err = flagsFromDB(ctx, db); err != nil {
 		return fmt.Errorf("failed Select flags: %w", err)
 	}
 
-	h.SinceDays = sinceDays
+	if h.tableRows, h.tableChanges, err = tablesFromDB(ctx, db, w); err != nil {
+		return fmt.Errorf("failed Select other tables: %w", err)
+	}
+
+	h.Window = w
+	return nil
+}
+
+// Prepare makes the history read by FromDB ready to show: looks up
+// addresses, makes thumbnails in destDir, and more. It takes a while,
+// and can be done outside of the transaction.
+func (h *History) Prepare(ctx context.Context, destDir string) error {
+	if h.ReverseCache == nil {
+		var err error
+		h.ReverseCache, err = reversecache.NewReverseCache(destDir)
+		if err != nil {
+			return err
+		}
+	}
 	h.destDir = destDir
-	return h.prepare()
+	return h.prepare(ctx)
 }
 
 // TODO: currently unused
@@ -225,68 +297,74 @@ func (h *History) FromDB(sinceDays int, destDir string) error {
 // 		return err
 // 	}
 
-// 	// note h.SinceDays is unknown here
+// 	// note h.Window is unknown here
 // 	h.prepare()
 
 // 	return nil
 // }
 
-func (h *History) prepare() error {
+func (h *History) prepare(ctx context.Context) error {
 	if err := os.MkdirAll(h.destDir, 0o755); err != nil {
 		return fmt.Errorf("failed MkdirAll: %w", err)
 	}
-	if err := os.MkdirAll(filepath.Join(h.destDir, imageDir), 0o755); err != nil {
-		return fmt.Errorf("failed MkdirAll: %w", err)
+	if h.Images == nil {
+		h.Images = images.NewHTTPSource(images.DefaultBucket)
+	}
+	if h.Thumbs == nil {
+		h.Thumbs = images.DirStore{Dir: h.destDir}
 	}
 
-	dmp := diffmatchpatch.New()
+	h.prepareFlags()
+
 	for idx := range h.entries {
 		he := &h.entries[idx]
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 
-		createImageThumb(he.Img.String(), h.destDir)
-		createImageThumb(he.ImgNew.String(), h.destDir)
+		if err := h.CreateImageThumb(ctx, he.Img.String()); err != nil {
+			he.ImgError = err.Error()
+		}
+		if err := h.CreateImageThumb(ctx, he.ImgNew.String()); err != nil {
+			he.ImgErrorNew = err.Error()
+		}
+		he.imgURL = he.thumb().URL(h.Images)
+		he.imgURLNew = he.thumbNew().URL(h.Images)
 
 		if he.Lat.Valid {
 			p := types.Pos{Lat: he.Lat.Float64, Lon: he.Lon.Float64}
-			if !h.reverseCache.Has(p) {
-				slog.Info(fmt.Sprintf("get reverse address for history entry %d", he.ChangeID))
-				h.reverseCache.Add(p)
-				time.Sleep(1 * time.Second)
-			}
-			he.Address = h.reverseCache.FormatAddress(p)
+			h.ReverseCache.Ensure(ctx, p, fmt.Sprintf("history entry %d", he.ChangeID))
+			he.Address = h.ReverseCache.FormatAddress(p)
+			he.Locality = h.ReverseCache.Locality(p)
 			he.Pos = p
 		}
 		if he.LatNew.Valid {
 			p := types.Pos{Lat: he.LatNew.Float64, Lon: he.LonNew.Float64}
-			if !h.reverseCache.Has(p) {
-				slog.Info(fmt.Sprintf("get reverse address (new) for history entry %d", he.ChangeID))
-				h.reverseCache.Add(p)
-				time.Sleep(1 * time.Second)
-			}
-			he.AddressNew = h.reverseCache.FormatAddress(p)
+			h.ReverseCache.Ensure(ctx, p, fmt.Sprintf("history entry %d (new)", he.ChangeID))
+			he.AddressNew = h.ReverseCache.FormatAddress(p)
+			he.LocalityNew = h.ReverseCache.Locality(p)
 			he.PosNew = p
 		}
 
 		switch he.ChangeOp {
 		case "DELETE":
-			h.Deletes++
-			// For a deleted tree: dig out reason in history of
-			// deleted flags of type "delete". A tree may have been
-			// flagged for deletion, then admin chose to not delete
-			// the tree, just the flag. But we show the reasons of all
-			// historic delete-flags.
-			for _, flag := range h.deletedFlags {
-				if flag.Type.String() != "delete" || flag.TreeKey != he.Key {
+			// For a deleted tree: dig out the history of its flags.
+			// A tree may have been flagged, then admin chose to not
+			// delete the tree, just the flag. But we show the reasons
+			// of all historic flags, of any type.
+			for _, flag := range h.flags {
+				if flag.TreeKey != he.Key || flag.Open() {
 					continue
 				}
-				he.DeleteReasons = append(he.DeleteReasons, flag.Reason.String())
+				he.DeleteFlags = append(he.DeleteFlags, flag)
 			}
-		case "INSERT":
-			h.Inserts++
 		case "UPDATE":
-			h.Updates++
-			he.DescDiff = dmp.DiffPrettyHtml(
-				dmp.DiffMain(he.Desc.String(), he.DescNew.String(), false))
+			he.DescDiff = diff.HTML(he.Desc.String(), he.DescNew.String())
+			he.Changes = he.fieldChanges()
+			if h.CompareImages && he.Img.String() != "" && he.ImgNew.String() != "" &&
+				he.Img != he.ImgNew && he.ImgError == "" && he.ImgErrorNew == "" {
+				he.ImgCompare = h.compareImages(he.Img.String(), he.ImgNew.String())
+			}
 			// Detect strange empty update
 			if he.Type == he.TypeNew &&
 				he.Desc == he.DescNew &&
@@ -297,117 +375,289 @@ func (h *History) prepare() error {
 		}
 	}
 
-	if err := h.reverseCache.Save(); err != nil {
-		slog.Error(fmt.Sprintf("failed reversecache.Save: %s", err))
+	if err := h.ReverseCache.Save(); err != nil {
+		runreport.Error(runreport.StageGeocode, fmt.Sprintf("failed reversecache.Save: %s", err))
 	}
 
 	sort.Slice(h.entries, func(i, j int) bool {
 		return h.entries[i].ChangeID > h.entries[j].ChangeID
 	})
 
+	h.count()
+
 	return nil
 }
 
-const (
-	imageDir     = "images"
-	imageFileFmt = "thumb_%s.jpg"
-)
-
-func imageFilePath(dbImgName string) string {
-	return filepath.Join(imageDir, fmt.Sprintf(imageFileFmt, dbImgName))
+func (h *History) count() {
+	h.Deletes, h.Inserts, h.Updates = 0, 0, 0
+	for idx := range h.entries {
+		switch h.entries[idx].ChangeOp {
+		case "DELETE":
+			h.Deletes++
+		case "INSERT":
+			h.Inserts++
+		case "UPDATE":
+			h.Updates++
+		}
+	}
 }
 
-func createImageThumb(dbImgName string, destDir string) {
-	if dbImgName == "" {
+// Filter keeps only the entries where the tree before or after the change
+// passes f, and the flags on trees that keepTree says to keep or that are
+// in the kept entries.
+func (h *History) Filter(f *filter.Filter, keepTree func(key string) bool) {
+	if f.Empty() {
 		return
 	}
 
-	imageURL := ImageURLBase + fmt.Sprintf(ImageURLPathFmt, dbImgName)
-	imageFileOutPath := filepath.Join(destDir, imageFilePath(dbImgName))
-
-	if _, err := os.Stat(imageFileOutPath); err == nil {
-		return
+	keys := make(map[string]bool)
+	entries := h.entries[:0]
+	for idx := range h.entries {
+		he := &h.entries[idx]
+		before := filter.Subject{
+			Op: he.ChangeOp, Type: he.Type.String(), By: he.By.String(),
+			Pos: he.Pos, HasPos: he.Lat.Valid,
+		}
+		after := filter.Subject{
+			Op: he.ChangeOp, Type: he.TypeNew.String(), By: he.ByNew.String(),
+			Pos: he.PosNew, HasPos: he.LatNew.Valid,
+		}
+		var match bool
+		switch he.ChangeOp {
+		case "DELETE":
+			match = f.Match(before)
+		case "INSERT":
+			match = f.Match(after)
+		default:
+			match = f.Match(before) || f.Match(after)
+		}
+		if match {
+			keys[he.Key.String()] = true
+			keys[he.KeyNew.String()] = true
+			entries = append(entries, *he)
+		}
 	}
+	h.entries = entries
 
-	data, err := fetchURL(imageURL)
-	if err != nil {
-		slog.Error(fmt.Sprintf("failed fetch %s: %s", imageURL, err))
-		return
+	flags := h.flags[:0]
+	for _, fl := range h.flags {
+		if keys[fl.TreeKey.String()] || keepTree(fl.TreeKey.String()) {
+			flags = append(flags, fl)
+		}
 	}
+	h.flags = flags
 
-	decoded, err := jpeg.Decode(bytes.NewReader(data))
-	if err != nil {
-		slog.Error(fmt.Sprintf("failed jpeg.Decode %s: %s", imageURL, err))
-		return
+	h.count()
+}
+
+// Sub gives the part of the history that is within the window w, which
+// should be within the window of h.
+func (h *History) Sub(w window.Window) *History {
+	sub := &History{
+		Window:       w,
+		Taxonomy:     h.Taxonomy,
+		FlagTypes:    h.FlagTypes,
+		destDir:      h.destDir,
+		ReverseCache: h.ReverseCache,
+	}
+	for idx := range h.entries {
+		if h.entries[idx].ChangeAt.Valid && w.Contains(h.entries[idx].ChangeAt.Time) {
+			sub.entries = append(sub.entries, h.entries[idx])
+		}
+	}
+	for _, row := range h.tableRows {
+		if row.ChangeAt.Valid && w.Contains(row.ChangeAt.Time) {
+			sub.tableRows = append(sub.tableRows, row)
+		}
+	}
+	sub.tableChanges = make(map[string][]TableChange)
+	for tab, changes := range h.tableChanges {
+		for _, c := range changes {
+			if c.ChangeAt.Valid && w.Contains(c.ChangeAt.Time) {
+				sub.tableChanges[tab] = append(sub.tableChanges[tab], c)
+			}
+		}
+	}
+	sub.flags = make([]Flag, len(h.flags))
+	for idx, f := range h.flags {
+		f.setInWindow(w)
+		sub.flags[idx] = f
 	}
+	sub.count()
+	return sub
+}
 
-	thumb := makeThumb(decoded)
+const (
+	// ImageDir is where thumbnails are kept, relative to destDir
+	ImageDir           = "images"
+	imageFileFmt       = "thumb_%s_%d.jpg"
+	placeholderFileFmt = "placeholder_%d.jpg"
+	// Reasons that images could not be processed, by name. Remove an
+	// image from it to try again.
+	imageFailuresFile = "image_failures.json"
+)
 
-	f, err := os.OpenFile(imageFileOutPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
-	if err != nil {
-		slog.Error(fmt.Sprintf("failed OpenFile %s: %s", imageFileOutPath, err))
-		return
+// CreateImageThumb makes the thumbnails of an image that are missing or
+// broken. Gives why it could not, then the image is to be shown with a
+// placeholder, see Thumb. Images that can not be processed (too large or
+// not decodable) are recorded as failed, and not fetched again.
+func (h *History) CreateImageThumb(ctx context.Context, dbImgName string) error {
+	if dbImgName == "" {
+		return nil
 	}
-	defer f.Close()
 
-	if err = jpeg.Encode(f, thumb, &jpeg.Options{Quality: 80}); err != nil {
-		slog.Error(fmt.Sprintf("failed jpeg.Encode %s: %s", imageFileOutPath, err))
-		_ = os.Remove(imageFileOutPath)
-		return
+	var missing []int
+	for _, size := range ThumbSizes {
+		if !h.validThumb(thumbFilePath(dbImgName, size)) {
+			missing = append(missing, size)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
 	}
 
-	slog.Info(fmt.Sprintf("downloaded %s", imageFileOutPath))
-}
-
-func fetchURL(url string) ([]byte, error) {
-	ctx, cancelFunc := context.WithTimeout(context.Background(), 15*time.Second)
-	defer cancelFunc()
+	if reason, ok := h.imageFailure(dbImgName); ok {
+		h.createPlaceholder()
+		return fmt.Errorf("%s", reason)
+	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	defer metrics.TimeStage(runreport.StageImages, time.Now())
+	data, err := h.Images.Fetch(ctx, dbImgName)
+	if ctx.Err() != nil {
+		return fmt.Errorf("failed fetch: %w", ctx.Err())
+	}
 	if err != nil {
-		return nil, err
+		metrics.ImageFetches.Inc("failure")
+		runreport.Error(runreport.StageImages, fmt.Sprintf("failed fetch %s: %s", h.Images.URL(dbImgName), err))
+		h.createPlaceholder()
+		if errors.Is(err, images.ErrTooLarge) {
+			h.recordImageFailure(dbImgName, err)
+		}
+		return fmt.Errorf("failed fetch: %w", err)
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	metrics.ImageFetches.Inc("success")
+
+	decoded, err := decodeImage(data)
 	if err != nil {
-		return nil, err
+		runreport.Error(runreport.StageImages, fmt.Sprintf("failed decode %s: %s", h.Images.URL(dbImgName), err))
+		h.createPlaceholder()
+		h.recordImageFailure(dbImgName, err)
+		return err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("response code not OK: %d", resp.StatusCode)
+	orientation := exifOrientation(data)
+	for _, size := range missing {
+		path := thumbFilePath(dbImgName, size)
+		if err = h.putImage(path, makeThumb(decoded, size, orientation)); err != nil {
+			runreport.Error(runreport.StageImages, fmt.Sprintf("failed write thumb %s: %s", path, err))
+			continue
+		}
+		slog.Info(fmt.Sprintf("downloaded %s", path))
 	}
+	return nil
+}
 
-	b, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+// HasThumbs tells whether the thumbnails of an image are made, or it is
+// recorded as failed, so that CreateImageThumb needs not fetch it
+func (h *History) HasThumbs(dbImgName string) bool {
+	if _, ok := h.imageFailure(dbImgName); ok {
+		return true
 	}
+	for _, size := range ThumbSizes {
+		path := thumbFilePath(dbImgName, size)
+		if !h.Thumbs.Has(path) || h.checkThumb(path) != nil {
+			return false
+		}
+	}
+	return true
+}
 
-	return b, nil
+// imageFailure gives the recorded reason that an image could not be
+// processed, if any
+func (h *History) imageFailure(dbImgName string) (string, bool) {
+	if h.imageFailures == nil {
+		h.imageFailures = make(map[string]string)
+		data, err := h.Thumbs.Get(imageFailuresFile)
+		if err == nil {
+			err = json.Unmarshal(data, &h.imageFailures)
+		}
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			runreport.Error(runreport.StageImages, fmt.Sprintf("failed read %s: %s", imageFailuresFile, err))
+		}
+	}
+	reason, ok := h.imageFailures[dbImgName]
+	return reason, ok
 }
 
-func makeThumb(decoded image.Image) *image.RGBA {
-	const sideMaxLen = 130
-	width := decoded.Bounds().Dx()
-	height := decoded.Bounds().Dy()
+// recordImageFailure records why an image could not be processed
+func (h *History) recordImageFailure(dbImgName string, reason error) {
+	h.imageFailure(dbImgName)
+	h.imageFailures[dbImgName] = reason.Error()
+	data, err := json.MarshalIndent(h.imageFailures, "", "  ")
+	if err == nil {
+		err = h.Thumbs.Put(imageFailuresFile, data)
+	}
+	if err != nil {
+		runreport.Error(runreport.StageImages, fmt.Sprintf("failed write %s: %s", imageFailuresFile, err))
+	}
+}
 
-	var thumb *image.RGBA
+// createPlaceholder makes the placeholder thumbnails, if missing
+func (h *History) createPlaceholder() {
+	for _, size := range ThumbSizes {
+		path := placeholderFilePath(size)
+		if h.validThumb(path) {
+			continue
+		}
+		if err := h.putImage(path, placeholder(size)); err != nil {
+			runreport.Error(runreport.StageImages, fmt.Sprintf("failed write placeholder %s: %s", path, err))
+		}
+	}
+}
 
-	if width <= sideMaxLen && height <= sideMaxLen {
-		thumb = image.NewRGBA(image.Rect(0, 0, width, height))
-		draw.Draw(thumb, thumb.Bounds(), decoded, decoded.Bounds().Min, draw.Over)
-		return thumb
+// validThumb tells whether the thumb is in the store and is a whole
+// image. Broken ones, like empty files left by a crash, are to be
+// recreated.
+func (h *History) validThumb(path string) bool {
+	if !h.Thumbs.Has(path) {
+		return false
+	}
+	if err := h.checkThumb(path); err != nil {
+		runreport.Warn(runreport.StageImages, fmt.Sprintf("invalid thumb %s, recreating: %s", path, err))
+		return false
 	}
+	return true
+}
 
-	if height > width {
-		// portrait
-		thumb = image.NewRGBA(image.Rect(0, 0, width/(height/sideMaxLen), sideMaxLen))
-	} else {
-		// landscape
-		thumb = image.NewRGBA(image.Rect(0, 0, sideMaxLen, height/(width/sideMaxLen)))
+// checkThumb tells why a thumb in the store is not a whole image, by the
+// cheap images.CheckThumb
+func (h *History) checkThumb(path string) error {
+	data, err := h.Thumbs.Get(path)
+	if err != nil {
+		return err
 	}
+	return images.CheckThumb(data)
+}
 
-	draw.BiLinear.Scale(thumb, thumb.Bounds(), decoded, decoded.Bounds(), draw.Over, nil)
+// putImage puts an image as JPEG in the thumb store
+func (h *History) putImage(path string, img image.Image) error {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 80}); err != nil {
+		return fmt.Errorf("failed jpeg.Encode: %w", err)
+	}
+	return h.Thumbs.Put(path, buf.Bytes())
+}
 
-	return thumb
+// getImage gets an image from the thumb store
+func (h *History) getImage(path string) (image.Image, error) {
+	data, err := h.Thumbs.Get(path)
+	if err != nil {
+		return nil, err
+	}
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed jpeg.Decode %s: %w", path, err)
+	}
+	return img, nil
 }
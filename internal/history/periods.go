@@ -0,0 +1,36 @@
+package history
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/fruktkartan/fruktsam/internal/util"
+	"github.com/fruktkartan/fruktsam/internal/window"
+	"github.com/jmoiron/sqlx"
+)
+
+// PeriodStat is what the history has for one calendar period. MaxID
+// changes whenever there are new history rows in the period.
+type PeriodStat struct {
+	Key   string
+	MaxID int
+	Count int
+}
+
+// PeriodsFromDB gets the periods of kind p that have history of trees or
+// flags, latest first.
+func PeriodsFromDB(ctx context.Context, db sqlx.QueryerContext, p window.Period) ([]PeriodStat, error) {
+	query := `SELECT ` + p.SQLKey() + ` AS key
+                   , MAX(id) AS maxid
+                   , COUNT(*) AS count
+                FROM history
+               WHERE tab IN ('trees', 'flags')
+            GROUP BY key
+            ORDER BY key DESC`
+
+	var periods []PeriodStat
+	if err := sqlx.SelectContext(ctx, db, &periods, query, util.Location().String()); err != nil {
+		return nil, fmt.Errorf("failed Select periods: %w", err)
+	}
+	return periods, nil
+}
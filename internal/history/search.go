@@ -0,0 +1,43 @@
+package history
+
+import (
+	"github.com/fruktkartan/fruktsam/internal/taxonomy"
+)
+
+// SearchEntry is one history entry in the search index that the page uses
+// for filtering. Keys are short to keep the index small.
+type SearchEntry struct {
+	ID       int    `json:"id"`
+	Op       string `json:"op"` // DELETE, INSERT or UPDATE
+	Type     string `json:"t"`  // species in the taxonomy, or raw type
+	By       string `json:"by"`
+	Locality string `json:"loc,omitempty"`
+	Desc     string `json:"d,omitempty"`
+}
+
+// SearchIndex gives the search index of the entries, in the same order.
+// For deleted trees the values are those before delete, for others after
+// the change.
+func (h *History) SearchIndex() []SearchEntry {
+	index := make([]SearchEntry, 0, len(h.entries))
+	for idx := range h.entries {
+		he := &h.entries[idx]
+		se := SearchEntry{
+			ID: he.ChangeID,
+			Op: he.ChangeOp,
+		}
+		if he.ChangeOp == "DELETE" {
+			se.Type = h.Taxonomy.Key(he.Type.String(), taxonomy.LevelSpecies)
+			se.By = he.By.String()
+			se.Locality = he.Locality
+			se.Desc = he.Desc.String()
+		} else {
+			se.Type = h.Taxonomy.Key(he.TypeNew.String(), taxonomy.LevelSpecies)
+			se.By = he.ByNew.String()
+			se.Locality = he.LocalityNew
+			se.Desc = he.DescNew.String()
+		}
+		index = append(index, se)
+	}
+	return index
+}
@@ -0,0 +1,229 @@
+package history
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/fruktkartan/fruktsam/internal/types"
+	"github.com/fruktkartan/fruktsam/internal/window"
+	"github.com/jmoiron/sqlx"
+)
+
+// Tables whose history is handled by History itself
+var builtinTables = []string{"trees", "flags"}
+
+// TableRenderer describes changes in the history of one table.
+type TableRenderer interface {
+	// Describe gives a one line, plain text, description of a change
+	Describe(c TableChange) string
+}
+
+var (
+	renderersMu sync.Mutex
+	renderers   = make(map[string]TableRenderer)
+)
+
+// RegisterRenderer makes changes to a table be shown in detail, using the
+// renderer. Changes to tables without a renderer are only counted.
+func RegisterRenderer(tab string, r TableRenderer) error {
+	if slices.Contains(builtinTables, tab) {
+		return fmt.Errorf("table %q is built-in, can't register renderer", tab)
+	}
+	renderersMu.Lock()
+	defer renderersMu.Unlock()
+	renderers[tab] = r
+	return nil
+}
+
+func rendererFor(tab string) (TableRenderer, bool) {
+	renderersMu.Lock()
+	defer renderersMu.Unlock()
+	r, ok := renderers[tab]
+	return r, ok
+}
+
+// TableChange is one row of history for a table, with the row before
+// and after the change.
+type TableChange struct {
+	ChangeID    int
+	ChangeAt    types.NullTime
+	ChangeOp    string
+	Old, New    map[string]any
+	Description string
+}
+
+// TableStat is the changes to one table during the window. Changes is
+// only filled in for tables with a registered renderer.
+type TableStat struct {
+	Tab                       string
+	Deletes, Inserts, Updates int
+	Changes                   []TableChange
+}
+
+func (ts TableStat) Count() int {
+	return ts.Deletes + ts.Inserts + ts.Updates
+}
+
+// FieldsRenderer describes a change by the values of some fields, or of
+// all fields if none are given. For updates only changed fields are shown.
+type FieldsRenderer struct {
+	Fields []string
+}
+
+func (r FieldsRenderer) Describe(c TableChange) string {
+	fields := r.Fields
+	if len(fields) == 0 {
+		seen := make(map[string]bool)
+		for k := range c.Old {
+			seen[k] = true
+		}
+		for k := range c.New {
+			seen[k] = true
+		}
+		for k := range seen {
+			fields = append(fields, k)
+		}
+		sort.Strings(fields)
+	}
+
+	var parts []string
+	for _, f := range fields {
+		o, hasOld := c.Old[f]
+		n, hasNew := c.New[f]
+		switch {
+		case hasOld && hasNew:
+			if fmt.Sprint(o) != fmt.Sprint(n) {
+				parts = append(parts, fmt.Sprintf("%s: %v → %v", f, o, n))
+			}
+		case hasNew:
+			parts = append(parts, fmt.Sprintf("%s: %v", f, n))
+		case hasOld:
+			parts = append(parts, fmt.Sprintf("%s: %v", f, o))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// tableRow is a change to a table other than the built-in ones
+type tableRow struct {
+	Tab      string
+	ChangeOp string
+	ChangeAt types.NullTime
+}
+
+type tableChangeRow struct {
+	ChangeID int
+	ChangeAt types.NullTime
+	ChangeOp string
+	OldJSON  []byte
+	NewJSON  []byte
+}
+
+// tablesFromDB gets the changes to all tables other than the built-in
+// ones, and the details of changes to those that have a renderer.
+func tablesFromDB(ctx context.Context, db sqlx.QueryerContext, w window.Window) ([]tableRow, map[string][]TableChange, error) {
+	query := `SELECT tab
+                   , op AS changeop
+                   , at AS changeat
+                FROM history
+               WHERE tab NOT IN ('` + strings.Join(builtinTables, "', '") + `')
+                 AND ` + window.Cond
+
+	var rows []tableRow
+	if err := sqlx.SelectContext(ctx, db, &rows, query, w.Args()...); err != nil {
+		return nil, nil, err
+	}
+
+	changes := make(map[string][]TableChange)
+	for _, row := range rows {
+		if _, done := changes[row.Tab]; done {
+			continue
+		}
+		r, ok := rendererFor(row.Tab)
+		if !ok {
+			continue
+		}
+		var err error
+		if changes[row.Tab], err = tableChangesFromDB(ctx, db, w, row.Tab, r); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return rows, changes, nil
+}
+
+// Tables gives the changes to tables other than trees and flags.
+func (h *History) Tables() []TableStat {
+	stats := make(map[string]*TableStat)
+	for _, row := range h.tableRows {
+		st, ok := stats[row.Tab]
+		if !ok {
+			st = &TableStat{Tab: row.Tab}
+			stats[row.Tab] = st
+		}
+		switch row.ChangeOp {
+		case "DELETE":
+			st.Deletes++
+		case "INSERT":
+			st.Inserts++
+		case "UPDATE":
+			st.Updates++
+		}
+	}
+
+	tables := make([]TableStat, 0, len(stats))
+	for _, st := range stats {
+		st.Changes = h.tableChanges[st.Tab]
+		tables = append(tables, *st)
+	}
+	sort.Slice(tables, func(i, j int) bool {
+		return tables[i].Tab < tables[j].Tab
+	})
+	return tables
+}
+
+func tableChangesFromDB(ctx context.Context, db sqlx.QueryerContext, w window.Window, tab string, r TableRenderer) ([]TableChange, error) {
+	query := `SELECT id AS changeid
+                   , at AS changeat
+                   , op AS changeop
+                   , old_json::text AS oldjson
+                   , new_json::text AS newjson
+                FROM history
+               WHERE tab=$3 AND ` + window.Cond + `
+            ORDER BY id DESC`
+
+	var rows []tableChangeRow
+	if err := sqlx.SelectContext(ctx, db, &rows, query, append(w.Args(), tab)...); err != nil {
+		return nil, err
+	}
+
+	changes := make([]TableChange, 0, len(rows))
+	for _, row := range rows {
+		c := TableChange{
+			ChangeID: row.ChangeID,
+			ChangeAt: row.ChangeAt,
+			ChangeOp: row.ChangeOp,
+		}
+		if err := unmarshalRow(row.OldJSON, &c.Old); err != nil {
+			return nil, fmt.Errorf("history %d: %w", row.ChangeID, err)
+		}
+		if err := unmarshalRow(row.NewJSON, &c.New); err != nil {
+			return nil, fmt.Errorf("history %d: %w", row.ChangeID, err)
+		}
+		c.Description = r.Describe(c)
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
+
+func unmarshalRow(data []byte, row *map[string]any) error {
+	if len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, row)
+}
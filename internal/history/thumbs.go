@@ -0,0 +1,287 @@
+package history
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif" // for image.Decode
+	_ "image/png"
+	"math"
+	"path/filepath"
+	"strings"
+
+	"github.com/fruktkartan/fruktsam/internal/images"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// maxPixels is the max width x height of an image to decode
+const maxPixels = 50_000_000
+
+// ThumbSizes are the max side lengths of the thumbnails made of each
+// image. The first is the size shown, the others are for high density
+// screens, see Entry.ImgSrcset.
+var ThumbSizes = []int{130, 260}
+
+// thumbFilePath is the path of the thumbnail of an image, relative to
+// destDir
+func thumbFilePath(dbImgName string, size int) string {
+	return filepath.Join(ImageDir, fmt.Sprintf(imageFileFmt, dbImgName, size))
+}
+
+// imageFilePath is the path of the thumbnail that is shown, of an image
+// that could be processed
+func imageFilePath(dbImgName string) string {
+	return thumbFilePath(dbImgName, ThumbSizes[0])
+}
+
+// ThumbFiles are the paths of all the thumbnails of an image, relative to
+// destDir
+func ThumbFiles(dbImgName string) []string {
+	if dbImgName == "" {
+		return nil
+	}
+	var files []string
+	for _, size := range ThumbSizes {
+		files = append(files, thumbFilePath(dbImgName, size))
+	}
+	return files
+}
+
+// placeholderFilePath is the path of the placeholder thumbnail, shown
+// for images that could not be processed
+func placeholderFilePath(size int) string {
+	return filepath.Join(ImageDir, fmt.Sprintf(placeholderFileFmt, size))
+}
+
+// PlaceholderFiles are the paths of all the sizes of the placeholder
+func PlaceholderFiles() []string {
+	var files []string
+	for _, size := range ThumbSizes {
+		files = append(files, placeholderFilePath(size))
+	}
+	return files
+}
+
+// Thumb is the thumbnail of an image to show, or the placeholder if the
+// image could not be processed
+type Thumb struct {
+	Name  string // of the image in the database
+	Error string // why the image could not be processed, empty if it could
+}
+
+func (t Thumb) path(size int) string {
+	if t.Error != "" {
+		return placeholderFilePath(size)
+	}
+	return thumbFilePath(t.Name, size)
+}
+
+// URL gives the URL of the full size image in src, empty if there is no
+// image
+func (t Thumb) URL(src images.Source) string {
+	if t.Name == "" {
+		return ""
+	}
+	return src.URL(t.Name)
+}
+
+// File is the path of the thumbnail that is shown, relative to destDir
+func (t Thumb) File() string {
+	if t.Name == "" {
+		return ""
+	}
+	return t.path(ThumbSizes[0])
+}
+
+// Files are the paths of all the sizes of the thumbnail
+func (t Thumb) Files() []string {
+	if t.Name == "" {
+		return nil
+	}
+	var files []string
+	for _, size := range ThumbSizes {
+		files = append(files, t.path(size))
+	}
+	return files
+}
+
+// Srcset gives the thumbnails for an img srcset, with paths prefixed by
+// base
+func (t Thumb) Srcset(base string) string {
+	if t.Name == "" {
+		return ""
+	}
+	var candidates []string
+	for _, size := range ThumbSizes {
+		candidates = append(candidates, fmt.Sprintf("%s%s %gx",
+			base, t.path(size), float64(size)/float64(ThumbSizes[0])))
+	}
+	return strings.Join(candidates, ", ")
+}
+
+// decodeImage decodes an image of any registered format: JPEG, PNG, GIF
+// or WebP. Images of more than maxPixels are refused, before decoding.
+func decodeImage(data []byte) (image.Image, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed image.DecodeConfig: %w", err)
+	}
+	if cfg.Width*cfg.Height > maxPixels {
+		return nil, fmt.Errorf("%s image too large: %dx%d pixels", format, cfg.Width, cfg.Height)
+	}
+	decoded, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed image.Decode %s: %w", format, err)
+	}
+	return decoded, nil
+}
+
+// placeholder is a gray square with a cross
+func placeholder(size int) image.Image {
+	img := image.NewGray(image.Rect(0, 0, size, size))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.Gray{Y: 0xdd}), image.Point{}, draw.Src)
+	for i := range size {
+		img.SetGray(i, i, color.Gray{Y: 0x99})
+		img.SetGray(size-1-i, i, color.Gray{Y: 0x99})
+	}
+	return img
+}
+
+// thumbBounds gives the size of a thumbnail of an image of width x height
+// with max side length sideMaxLen, keeping the aspect ratio. Images are
+// not scaled up.
+func thumbBounds(width, height, sideMaxLen int) image.Rectangle {
+	if width <= sideMaxLen && height <= sideMaxLen {
+		return image.Rect(0, 0, width, height)
+	}
+	scale := float64(sideMaxLen) / float64(max(width, height))
+	w := max(1, int(math.Round(float64(width)*scale)))
+	h := max(1, int(math.Round(float64(height)*scale)))
+	return image.Rect(0, 0, w, h)
+}
+
+func makeThumb(decoded image.Image, sideMaxLen int, orientation int) image.Image {
+	b := decoded.Bounds()
+	thumb := image.NewRGBA(thumbBounds(b.Dx(), b.Dy(), sideMaxLen))
+	if thumb.Bounds().Size() == b.Size() {
+		draw.Draw(thumb, thumb.Bounds(), decoded, b.Min, draw.Src)
+	} else {
+		draw.CatmullRom.Scale(thumb, thumb.Bounds(), decoded, b, draw.Src, nil)
+	}
+	return orient(thumb, orientation)
+}
+
+// orient transforms an image as given by an EXIF orientation, so that it
+// is shown the right way up
+func orient(img *image.RGBA, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	// Orientations 5-8 swap width and height
+	transpose := orientation >= 5
+	out := image.NewRGBA(image.Rect(0, 0, w, h))
+	if transpose {
+		out = image.NewRGBA(image.Rect(0, 0, h, w))
+	}
+
+	for y := range h {
+		for x := range w {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored
+				dx, dy = w-1-x, y
+			case 3: // rotated 180
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirrored vertically
+				dx, dy = x, h-1-y
+			case 5: // mirrored and rotated 270 CW
+				dx, dy = y, x
+			case 6: // rotated 90 CW
+				dx, dy = h-1-y, x
+			case 7: // mirrored and rotated 90 CW
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotated 270 CW
+				dx, dy = y, w-1-x
+			}
+			out.SetRGBA(dx, dy, img.RGBAAt(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return out
+}
+
+// exifOrientation finds the EXIF orientation tag in JPEG data. Gives 1
+// (normal) if there is none.
+func exifOrientation(data []byte) int {
+	const (
+		markerSOI         = 0xd8
+		markerAPP1        = 0xe1
+		markerSOS         = 0xda
+		tagOrientation    = 0x0112
+		exifHeader        = "Exif\x00\x00"
+		ifdEntrySize      = 12
+		normalOrientation = 1
+	)
+
+	if len(data) < 4 || data[0] != 0xff || data[1] != markerSOI {
+		return normalOrientation
+	}
+
+	// Walk the segments up to the image data
+	for pos := 2; pos+4 <= len(data); {
+		if data[pos] != 0xff {
+			return normalOrientation
+		}
+		marker := data[pos+1]
+		if marker == markerSOS {
+			return normalOrientation
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return normalOrientation
+		}
+		seg := data[pos+4 : end]
+		pos = end
+		if marker != markerAPP1 || !strings.HasPrefix(string(seg), exifHeader) {
+			continue
+		}
+
+		tiff := seg[len(exifHeader):]
+		if len(tiff) < 8 {
+			return normalOrientation
+		}
+		var order binary.ByteOrder
+		switch string(tiff[:2]) {
+		case "II":
+			order = binary.LittleEndian
+		case "MM":
+			order = binary.BigEndian
+		default:
+			return normalOrientation
+		}
+
+		ifd := int(order.Uint32(tiff[4:]))
+		if ifd+2 > len(tiff) {
+			return normalOrientation
+		}
+		count := int(order.Uint16(tiff[ifd:]))
+		for i := range count {
+			entry := ifd + 2 + i*ifdEntrySize
+			if entry+ifdEntrySize > len(tiff) {
+				break
+			}
+			if order.Uint16(tiff[entry:]) == tagOrientation {
+				return int(order.Uint16(tiff[entry+8:]))
+			}
+		}
+		return normalOrientation
+	}
+
+	return normalOrientation
+}
@@ -0,0 +1,107 @@
+package i18n
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+//go:embed *.json
+var catalogs embed.FS
+
+const DefaultLang = "sv"
+
+// messages of the current language, falling back to those of the default
+// language for missing keys
+var messages, fallback map[string]string
+
+var lang string
+
+func init() {
+	var err error
+	if fallback, err = load(DefaultLang); err != nil {
+		panic(err)
+	}
+	messages, lang = fallback, DefaultLang
+}
+
+func load(l string) (map[string]string, error) {
+	data, err := catalogs.ReadFile(l + ".json")
+	if err != nil {
+		return nil, fmt.Errorf("no messages for language %q, have %s", l, strings.Join(Langs(), ", "))
+	}
+	var m map[string]string
+	if err = json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed Unmarshal messages %s: %w", l, err)
+	}
+	return m, nil
+}
+
+// Langs gives the languages that there are messages for
+func Langs() []string {
+	var langs []string
+	entries, _ := catalogs.ReadDir(".")
+	for _, e := range entries {
+		langs = append(langs, strings.TrimSuffix(e.Name(), ".json"))
+	}
+	return langs
+}
+
+// Set sets the language of the messages. Empty means the default.
+func Set(l string) error {
+	if l == "" {
+		l = DefaultLang
+	}
+	m, err := load(l)
+	if err != nil {
+		return err
+	}
+	messages, lang = m, l
+	return nil
+}
+
+// Lang is the current language
+func Lang() string {
+	return lang
+}
+
+// T gives the message with the key, formatted with args like fmt.Sprintf.
+// A missing message gives the key itself.
+func T(key string, args ...any) string {
+	msg, ok := messages[key]
+	if !ok {
+		if msg, ok = fallback[key]; !ok {
+			msg = key
+		}
+	}
+	if len(args) == 0 {
+		return msg
+	}
+	return fmt.Sprintf(msg, args...)
+}
+
+// TN is like T for a message about n things, using the message with
+// suffix ".one" if n is 1 and there is one.
+func TN(key string, n int, args ...any) string {
+	if n == 1 {
+		if _, ok := messages[key+".one"]; ok {
+			key += ".one"
+		}
+	}
+	return T(key, append([]any{n}, args...)...)
+}
+
+// Messages gives the messages with keys starting with prefix, with the
+// prefix removed, for use in scripts.
+func Messages(prefix string) map[string]string {
+	m := make(map[string]string)
+	for _, src := range []map[string]string{fallback, messages} {
+		for key, msg := range src {
+			if k, ok := strings.CutPrefix(key, prefix); ok {
+				m[k] = msg
+			}
+		}
+	}
+	return m
+}
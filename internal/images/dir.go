@@ -0,0 +1,92 @@
+package images
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/google/renameio/v2"
+)
+
+// DirSource gets images from a local directory, like a fixture or a
+// mirror of the bucket
+type DirSource struct {
+	Dir string
+}
+
+func (s DirSource) path(name string) string {
+	return filepath.Join(s.Dir, fmt.Sprintf(ObjectFmt, name))
+}
+
+func (s DirSource) URL(name string) string {
+	abs, err := filepath.Abs(s.path(name))
+	if err != nil {
+		return ""
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(abs)}).String()
+}
+
+func (s DirSource) Fetch(_ context.Context, name string) ([]byte, error) {
+	f, err := os.Open(s.path(name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readLimited(f)
+}
+
+// DirStore keeps thumbnails in a local directory
+type DirStore struct {
+	Dir string
+}
+
+func (s DirStore) Has(path string) bool {
+	_, err := os.Stat(filepath.Join(s.Dir, path))
+	return err == nil
+}
+
+func (s DirStore) Get(path string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(s.Dir, path))
+}
+
+func (s DirStore) Delete(path string) error {
+	return os.Remove(filepath.Join(s.Dir, path))
+}
+
+func (s DirStore) List(dir string) ([]File, error) {
+	var files []File
+	err := filepath.WalkDir(filepath.Join(s.Dir, dir), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.Dir, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, File{Path: rel, Size: info.Size()})
+		return nil
+	})
+	return files, err
+}
+
+func (s DirStore) Put(path string, data []byte) error {
+	path = filepath.Join(s.Dir, path)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed MkdirAll: %w", err)
+	}
+	return renameio.WriteFile(path, data, 0o644)
+}
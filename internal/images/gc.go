@@ -0,0 +1,91 @@
+package images
+
+import (
+	"bytes"
+	"fmt"
+	"image/jpeg"
+)
+
+// Usage is the disk usage of some files
+type Usage struct {
+	Files int
+	Bytes int64
+}
+
+// Add counts the file
+func (u *Usage) Add(f File) {
+	u.Files++
+	u.Bytes += f.Size
+}
+
+func (u Usage) String() string {
+	return fmt.Sprintf("%d files, %.1f MB", u.Files, float64(u.Bytes)/(1<<20))
+}
+
+// GCResult is what GC did
+type GCResult struct {
+	Kept, Unused, Invalid Usage
+}
+
+// CheckJPEG checks that data is a whole, decodable JPEG image
+func CheckJPEG(data []byte) error {
+	if len(data) == 0 {
+		return fmt.Errorf("empty file")
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("failed jpeg.Decode: %w", err)
+	}
+	return nil
+}
+
+// CheckThumb is a cheap check that data is a whole JPEG image, as written
+// by us: that its header can be decoded and that it is not cut short.
+// A run uses it on every thumbnail, leaving the full check of CheckJPEG
+// to GC.
+func CheckThumb(data []byte) error {
+	if len(data) == 0 {
+		return fmt.Errorf("empty file")
+	}
+	if _, err := jpeg.DecodeConfig(bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("failed jpeg.DecodeConfig: %w", err)
+	}
+	if !bytes.HasSuffix(data, []byte{0xff, 0xd9}) {
+		return fmt.Errorf("no end of image, cut short")
+	}
+	return nil
+}
+
+// GC removes the files in dir of the store that are not in keep, and the
+// ones that are not valid JPEG images (to be recreated).
+func GC(store ThumbStore, dir string, keep map[string]bool) (GCResult, error) {
+	var res GCResult
+	files, err := store.List(dir)
+	if err != nil {
+		return res, fmt.Errorf("failed List: %w", err)
+	}
+
+	for _, f := range files {
+		if !keep[f.Path] {
+			if err = store.Delete(f.Path); err != nil {
+				return res, fmt.Errorf("failed Delete: %w", err)
+			}
+			res.Unused.Add(f)
+			continue
+		}
+
+		var data []byte
+		if data, err = store.Get(f.Path); err != nil {
+			return res, fmt.Errorf("failed Get: %w", err)
+		}
+		if CheckJPEG(data) != nil {
+			if err = store.Delete(f.Path); err != nil {
+				return res, fmt.Errorf("failed Delete: %w", err)
+			}
+			res.Invalid.Add(f)
+			continue
+		}
+		res.Kept.Add(f)
+	}
+
+	return res, nil
+}
@@ -0,0 +1,34 @@
+package images
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"testing"
+)
+
+func TestCheckThumb(t *testing.T) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 40, 30)), nil); err != nil {
+		t.Fatal(err)
+	}
+	whole := buf.Bytes()
+
+	tests := []struct {
+		name string
+		data []byte
+		ok   bool
+	}{
+		{"whole", whole, true},
+		{"empty", nil, false},
+		{"cut short", whole[:len(whole)/2], false},
+		{"not jpeg", []byte("<html></html>"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := CheckThumb(tt.data); (err == nil) != tt.ok {
+				t.Errorf("CheckThumb() = %v, want ok %t", err, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package images
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const fetchTimeout = 15 * time.Second
+
+// HTTPSource gets images from a public bucket, or any web server
+type HTTPSource struct {
+	Base   string // URL that the object names are relative to
+	Client *http.Client
+}
+
+func NewHTTPSource(base string) *HTTPSource {
+	return &HTTPSource{Base: strings.TrimSuffix(base, "/"), Client: http.DefaultClient}
+}
+
+func (s *HTTPSource) URL(name string) string {
+	return s.Base + "/" + fmt.Sprintf(ObjectFmt, name)
+}
+
+func (s *HTTPSource) Fetch(ctx context.Context, name string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL(name), nil)
+	if err != nil {
+		return nil, err
+	}
+	return fetch(s.Client, req)
+}
+
+func fetch(client *http.Client, req *http.Request) ([]byte, error) {
+	ctx, cancelFunc := context.WithTimeout(req.Context(), fetchTimeout)
+	defer cancelFunc()
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("response code not OK: %d", resp.StatusCode)
+	}
+	if resp.ContentLength > MaxSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrTooLarge, resp.ContentLength)
+	}
+
+	return readLimited(resp.Body)
+}
@@ -0,0 +1,82 @@
+package images
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ObjectFmt is the name of the full size image, in a bucket or directory,
+// of an image with a name in the database.
+const ObjectFmt = "%s_1200.jpg"
+
+// DefaultBucket is where fruktkartan keeps the images
+const DefaultBucket = "https://fruktkartan-thumbs.s3.eu-north-1.amazonaws.com"
+
+// MaxSize is the max size in bytes of an image to fetch
+var MaxSize int64 = 20 << 20
+
+// ErrTooLarge is given when an image is larger than MaxSize
+var ErrTooLarge = errors.New("image too large")
+
+// readLimited reads r, failing with ErrTooLarge if it is larger than
+// MaxSize
+func readLimited(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, MaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > MaxSize {
+		return nil, fmt.Errorf("%w: more than %d bytes", ErrTooLarge, MaxSize)
+	}
+	return data, nil
+}
+
+// Source gives the full size images of trees, by their name in the
+// database
+type Source interface {
+	Fetch(ctx context.Context, name string) ([]byte, error)
+	// URL links to the image, for the page
+	URL(name string) string
+}
+
+// ThumbStore keeps thumbnails, by paths relative to it
+type ThumbStore interface {
+	Has(path string) bool
+	Get(path string) ([]byte, error)
+	Put(path string, data []byte) error
+	Delete(path string) error
+	// List gives the files in dir, and in dirs in it
+	List(dir string) ([]File, error)
+}
+
+// File is a file in a ThumbStore
+type File struct {
+	Path string
+	Size int64
+}
+
+// ParseSource gives the source of images from a spec:
+//
+//   - empty: the fruktkartan bucket
+//   - http:// or https:// URL: a bucket (or any web server) with the images
+//   - "s3": an S3-compatible endpoint, configured by env variables, see
+//     S3SourceFromEnv
+//   - otherwise, a local directory with the images
+func ParseSource(spec string) (Source, error) {
+	switch {
+	case spec == "":
+		return NewHTTPSource(DefaultBucket), nil
+	case strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://"):
+		return NewHTTPSource(spec), nil
+	case spec == "s3":
+		return S3SourceFromEnv()
+	}
+	if fi, err := os.Stat(spec); err != nil || !fi.IsDir() {
+		return nil, fmt.Errorf("image source %q is not a URL, s3 or a directory", spec)
+	}
+	return DirSource{Dir: spec}, nil
+}
@@ -0,0 +1,156 @@
+package images
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Source gets images from a bucket on an S3-compatible endpoint, like
+// MinIO, signing the requests if there are credentials.
+type S3Source struct {
+	Endpoint        string // like http://localhost:9000
+	Bucket          string
+	Region          string
+	AccessKeyID     string // empty for anonymous access
+	SecretAccessKey string
+	Client          *http.Client
+}
+
+// S3SourceFromEnv configures an S3Source from env variables S3_ENDPOINT,
+// S3_BUCKET, S3_REGION (default us-east-1), and optionally
+// S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY.
+func S3SourceFromEnv() (*S3Source, error) {
+	s := S3Source{
+		Endpoint:        strings.TrimSuffix(os.Getenv("S3_ENDPOINT"), "/"),
+		Bucket:          os.Getenv("S3_BUCKET"),
+		Region:          os.Getenv("S3_REGION"),
+		AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+		Client:          http.DefaultClient,
+	}
+	if s.Endpoint == "" || s.Bucket == "" {
+		return nil, fmt.Errorf("env variables S3_ENDPOINT and S3_BUCKET are needed")
+	}
+	if _, err := url.Parse(s.Endpoint); err != nil {
+		return nil, fmt.Errorf("S3_ENDPOINT: %w", err)
+	}
+	if s.Region == "" {
+		s.Region = "us-east-1"
+	}
+	if (s.AccessKeyID == "") != (s.SecretAccessKey == "") {
+		return nil, fmt.Errorf("env variables S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY go together")
+	}
+	return &s, nil
+}
+
+// URL is the path-style URL of the image. It can only be opened if the
+// bucket allows anonymous access.
+func (s *S3Source) URL(name string) string {
+	return s.Endpoint + s.path(name)
+}
+
+func (s *S3Source) path(name string) string {
+	return "/" + uriEncode(s.Bucket) + "/" + uriEncode(fmt.Sprintf(ObjectFmt, name))
+}
+
+func (s *S3Source) Fetch(ctx context.Context, name string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL(name), nil)
+	if err != nil {
+		return nil, err
+	}
+	if s.AccessKeyID != "" {
+		s.sign(req, s.path(name), time.Now())
+	}
+	return fetch(s.Client, req)
+}
+
+// sign signs a GET request with AWS signature version 4, with the host
+// and the headers of the request. The payload is not signed, unless its
+// hash is already in header X-Amz-Content-Sha256.
+func (s *S3Source) sign(req *http.Request, path string, now time.Time) {
+	const (
+		algorithm       = "AWS4-HMAC-SHA256"
+		unsignedPayload = "UNSIGNED-PAYLOAD"
+		service         = "s3"
+	)
+
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	payloadHash := req.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		payloadHash = unsignedPayload
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		"", // query
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{date, s.Region, service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{algorithm, amzDate, scope, sha256Hex(canonicalRequest)}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretAccessKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		algorithm, s.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// uriEncode encodes like S3 expects in a path: all but the unreserved
+// characters of RFC 3986
+func uriEncode(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
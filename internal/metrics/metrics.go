@@ -0,0 +1,188 @@
+// Package metrics keeps metrics of runs, for Prometheus. They are written
+// in the text format, to a file for the textfile collector of
+// node_exporter, or served over HTTP.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fruktkartan/fruktsam/internal/runreport"
+	"github.com/google/renameio/v2"
+)
+
+// Metric is a gauge or counter, with values by label values
+type Metric struct {
+	name, help, kind string
+	labels           []string
+	values           map[string]float64 // by label values joined by \xff
+	staged           map[string]float64 // of the run going on, if a gauge of the run
+}
+
+var (
+	mu      sync.Mutex
+	metrics []*Metric
+)
+
+func newMetric(name, help, kind string, labels ...string) *Metric {
+	m := &Metric{name: name, help: help, kind: kind, labels: labels, values: make(map[string]float64)}
+	metrics = append(metrics, m)
+	return m
+}
+
+// Metrics of fruktsam. Gauges are of the last run, counters are since
+// start.
+var (
+	Trees = newMetric("fruktsam_trees",
+		"Current trees, by species in the taxonomy, with types not in it as other.", "gauge", "species")
+	Changes = newMetric("fruktsam_report_changes",
+		"Changes of trees in the window of a report, by op.", "gauge", "report", "op")
+	GeocodeLookups = newMetric("fruktsam_geocode_lookups_total",
+		"Lookups of addresses, by result: hit (in the cache), miss or failure (of nominatim).",
+		"counter", "result")
+	ImageFetches = newMetric("fruktsam_image_fetches_total",
+		"Fetches of images to make thumbnails of, by result: success or failure.", "counter", "result")
+	StageSeconds = newMetric("fruktsam_stage_duration_seconds",
+		"Time spent in each stage of the last run.", "gauge", "stage")
+	LastRun = newMetric("fruktsam_last_run_timestamp_seconds",
+		"When the last run ended.", "gauge")
+	LastRunSuccess = newMetric("fruktsam_last_run_success",
+		"Whether the last run completed (1) or not (0).", "gauge")
+	LastRunErrors = newMetric("fruktsam_last_run_errors",
+		"Errors and warnings during the last run, by stage and level.", "gauge", "stage", "level")
+)
+
+func key(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+// current gives the values to change, the staged ones during a run
+func (m *Metric) current() map[string]float64 {
+	if m.staged != nil {
+		return m.staged
+	}
+	return m.values
+}
+
+// Set sets the value for the label values
+func (m *Metric) Set(v float64, labelValues ...string) {
+	mu.Lock()
+	defer mu.Unlock()
+	m.current()[key(labelValues)] = v
+}
+
+// Add adds to the value for the label values
+func (m *Metric) Add(v float64, labelValues ...string) {
+	mu.Lock()
+	defer mu.Unlock()
+	m.current()[key(labelValues)] += v
+}
+
+func (m *Metric) Inc(labelValues ...string) {
+	m.Add(1, labelValues...)
+}
+
+// TimeStage adds the time since start to the time spent in the stage
+func TimeStage(stage runreport.Stage, start time.Time) {
+	StageSeconds.Add(time.Since(start).Seconds(), string(stage))
+}
+
+// runGauges are the gauges of the last run, by label values that may be
+// gone in the next
+var runGauges = []*Metric{Trees, Changes, StageSeconds, LastRunErrors}
+
+// StartRun starts staging the gauges of the run, so that those of the last
+// run are written until it finishes
+func StartRun() {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, m := range runGauges {
+		m.staged = make(map[string]float64)
+	}
+}
+
+// FinishRun records the result of the run, and swaps in its gauges
+func FinishRun(rep runreport.Report) {
+	LastRun.Set(float64(rep.End.Unix()))
+	success := 0.0
+	if rep.OK {
+		success = 1
+	}
+	LastRunSuccess.Set(success)
+	for _, issue := range rep.Issues {
+		LastRunErrors.Inc(string(issue.Stage), issue.Level)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, m := range runGauges {
+		if m.staged != nil {
+			m.values, m.staged = m.staged, nil
+		}
+	}
+}
+
+// Write writes the metrics in the Prometheus text format
+func Write(w io.Writer) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	var b bytes.Buffer
+	for _, m := range metrics {
+		fmt.Fprintf(&b, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(&b, "# TYPE %s %s\n", m.name, m.kind)
+		keys := make([]string, 0, len(m.values))
+		for k := range m.values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			b.WriteString(m.name)
+			if len(m.labels) > 0 {
+				var pairs []string
+				for idx, value := range strings.Split(k, "\xff") {
+					pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", m.labels[idx], escape(value)))
+				}
+				b.WriteString("{" + strings.Join(pairs, ",") + "}")
+			}
+			b.WriteString(" " + strconv.FormatFloat(m.values[k], 'f', -1, 64) + "\n")
+		}
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// escape escapes a label value
+func escape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// WriteFile writes the metrics to a file, atomically as the textfile
+// collector needs. The file name should end in .prom.
+func WriteFile(file string) error {
+	var b bytes.Buffer
+	if err := Write(&b); err != nil {
+		return err
+	}
+	if err := renameio.WriteFile(file, b.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("failed WriteFile: %w", err)
+	}
+	return nil
+}
+
+// Handler serves the metrics
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := Write(w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
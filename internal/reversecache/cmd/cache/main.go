@@ -0,0 +1,107 @@
+// Command cache adds a real-world nominatim response to the corpus that
+// FormatAddress is tested against:
+//
+//	go run ./internal/reversecache/cmd/cache [flags] name lat,lon
+//
+// The response is taken from the reversecache in -cache if there, else
+// looked up at nominatim. It is written to name.json in -dir, and the case
+// to add to formatAddressTests is printed, with the address as currently
+// formatted. Check that it is what it should be before adding it.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/fruktkartan/fruktsam/internal/reversecache"
+	"github.com/fruktkartan/fruktsam/internal/types"
+)
+
+func main() {
+	log.SetFlags(0)
+	if err := run(); err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	var cacheDir, corpusDir string
+	var force bool
+	flag.StringVar(&cacheDir, "cache", "dist", "`directory` with a reversecache to take the response from, if there")
+	flag.StringVar(&corpusDir, "dir", "internal/reversecache/testdata/nominatim", "Corpus `directory` to write to")
+	flag.BoolVar(&force, "f", false, "Overwrite the case if it exists")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] name lat,lon\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		return fmt.Errorf("expected name and position")
+	}
+	name := flag.Arg(0)
+	p, err := parsePos(flag.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	file := filepath.Join(corpusDir, name+".json")
+	if _, err = os.Stat(file); err == nil && !force {
+		return fmt.Errorf("%s exists, overwrite with -f", file)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	// Not saved, the cache is only read from
+	rc, err := reversecache.NewReverseCache(cacheDir)
+	if err != nil {
+		return err
+	}
+	rc.Ensure(ctx, p, name)
+	resp, ok := rc.Response(p)
+	if !ok || resp == nil {
+		return fmt.Errorf("no response for %v", p)
+	}
+
+	var buf bytes.Buffer
+	if err = json.Indent(&buf, resp, "", "  "); err != nil {
+		return fmt.Errorf("failed Indent: %w", err)
+	}
+	buf.WriteByte('\n')
+	if err = os.WriteFile(file, buf.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("failed WriteFile: %w", err)
+	}
+	slog.Info(fmt.Sprintf("Wrote %s", file))
+
+	fmt.Printf("\t{%q, %q},\n", name, rc.FormatAddress(p))
+	return nil
+}
+
+// parsePos parses a position like 55.6050,13.0038
+func parsePos(s string) (types.Pos, error) {
+	lat, lon, ok := strings.Cut(s, ",")
+	if !ok {
+		return types.Pos{}, fmt.Errorf("position %q is not lat,lon", s)
+	}
+	var p types.Pos
+	var err error
+	if p.Lat, err = strconv.ParseFloat(strings.TrimSpace(lat), 64); err != nil {
+		return types.Pos{}, fmt.Errorf("position %q: %w", s, err)
+	}
+	if p.Lon, err = strconv.ParseFloat(strings.TrimSpace(lon), 64); err != nil {
+		return types.Pos{}, fmt.Errorf("position %q: %w", s, err)
+	}
+	return p, nil
+}
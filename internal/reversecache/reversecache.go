@@ -15,6 +15,8 @@ import (
 	"strings"
 	"time"
 
+	"github.com/fruktkartan/fruktsam/internal/metrics"
+	"github.com/fruktkartan/fruktsam/internal/runreport"
 	"github.com/fruktkartan/fruktsam/internal/types"
 	"github.com/google/renameio/v2"
 )
@@ -23,6 +25,14 @@ import (
 
 const reverseFile = "reversecache"
 
+// NominatimURL is the reverse geocoding endpoint that addresses are looked
+// up at.
+var NominatimURL = "https://nominatim.openstreetmap.org/reverse"
+
+// LookupInterval is the least time between lookups, nominatim asks for at
+// most one a second.
+var LookupInterval = 1 * time.Second
+
 type ReverseCache struct {
 	Table     apiResults // exported for gob
 	cacheFile string
@@ -45,21 +55,54 @@ func (r *ReverseCache) Has(p types.Pos) bool {
 	return ok
 }
 
-func (r *ReverseCache) Add(p types.Pos) {
+// Response gives the nominatim response for p as cached, nil if the
+// lookup got nothing. False if p is not in the cache.
+func (r *ReverseCache) Response(p types.Pos) ([]byte, bool) {
+	b, ok := r.Table[p]
+	return b, ok
+}
+
+// Ensure looks up the address of p, for what (for the log), if it is not
+// in the cache. Lookups are spaced by LookupInterval.
+// Nothing is looked up when ctx is done.
+func (r *ReverseCache) Ensure(ctx context.Context, p types.Pos, what string) {
+	if r.Has(p) {
+		metrics.GeocodeLookups.Inc("hit")
+		return
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	defer metrics.TimeStage(runreport.StageGeocode, time.Now())
+	slog.Info(fmt.Sprintf("get reverse address for %s", what))
+	r.Add(ctx, p)
+	select {
+	case <-ctx.Done():
+	case <-time.After(LookupInterval):
+	}
+}
+
+func (r *ReverseCache) Add(ctx context.Context, p types.Pos) {
 	if r.Has(p) {
 		return
 	}
-	jsonbytes, err := reverse(p)
+	jsonbytes, err := reverse(ctx, p)
+	if ctx.Err() != nil {
+		// Interrupted, nothing added
+		return
+	}
 	if err != nil {
+		metrics.GeocodeLookups.Inc("failure")
 		var httpErr httpError
 		if errors.As(err, &httpErr) {
-			slog.Info(fmt.Sprintf("Reversecache: %v: %s (nothing added)", p, err))
+			runreport.Error(runreport.StageGeocode, fmt.Sprintf("Reversecache: %v: %s (nothing added)", p, err))
 		} else {
-			slog.Info(fmt.Sprintf("Reversecache: %v: %s (added nil)", p, err))
+			runreport.Warn(runreport.StageGeocode, fmt.Sprintf("Reversecache: %v: %s (added nil)", p, err))
 			// We store in reversecache even if we got nothing
 			r.Table[p] = nil
 		}
 	} else {
+		metrics.GeocodeLookups.Inc("miss")
 		r.Table[p] = jsonbytes
 	}
 	r.dirty = true
@@ -193,6 +236,44 @@ func (r *ReverseCache) FormatAddress(p types.Pos) string {
 	return s
 }
 
+// Locality gives the city, town, village or hamlet that p is in, or
+// else the municipality. Empty if not known.
+func (r *ReverseCache) Locality(p types.Pos) string {
+	a, ok := r.address(p)
+	if !ok {
+		return ""
+	}
+	loc := a.locality()
+	if loc == "Tätort Göteborg" {
+		loc = "Göteborg"
+	}
+	if loc == "" {
+		loc = a.Municipality
+	}
+	return loc
+}
+
+// Municipality gives the municipality (kommun) that p is in. Empty if not
+// known.
+func (r *ReverseCache) Municipality(p types.Pos) string {
+	a, ok := r.address(p)
+	if !ok {
+		return ""
+	}
+	return a.Municipality
+}
+
+func (r *ReverseCache) address(p types.Pos) (address, bool) {
+	if len(r.Table[p]) == 0 {
+		return address{}, false
+	}
+	root := osm{}
+	if err := json.Unmarshal(r.Table[p], &root); err != nil {
+		return address{}, false
+	}
+	return root.Address, true
+}
+
 type httpError struct {
 	statusCode int
 }
@@ -201,8 +282,8 @@ func (e httpError) Error() string {
 	return fmt.Sprintf("HTTP StatusCode: %d", e.statusCode)
 }
 
-func reverse(p types.Pos) ([]byte, error) {
-	req, _ := http.NewRequestWithContext(context.Background(), "GET", "https://nominatim.openstreetmap.org/reverse", nil)
+func reverse(ctx context.Context, p types.Pos) ([]byte, error) {
+	req, _ := http.NewRequestWithContext(ctx, "GET", NominatimURL, nil)
 	req.Header.Add("accept", "application/json")
 	req.Header.Add("user-agent", "fruktsam (https://github.com/fruktkartan/fruktsam)")
 	req.Header.Add("accept-language", "sv,en-US,en")
@@ -0,0 +1,176 @@
+// Package runreport collects what went wrong during a run, per stage, for
+// a summary at the end and for alerting.
+package runreport
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/renameio/v2"
+)
+
+type Stage string
+
+// Stages of a run
+const (
+	StageDB      Stage = "db"
+	StageGeocode Stage = "geocode"
+	StageImages  Stage = "images"
+	StageRender  Stage = "render"
+)
+
+// Levels of issues
+const (
+	LevelWarning = "warning"
+	LevelError   = "error"
+	LevelFatal   = "fatal" // the run was stopped
+)
+
+type Issue struct {
+	Stage   Stage  `json:"stage"`
+	Level   string `json:"level"`
+	Message string `json:"message"`
+}
+
+// Report is what happened during a run
+type Report struct {
+	Start  time.Time      `json:"start"`
+	End    time.Time      `json:"end"`
+	OK     bool           `json:"ok"`              // completed, with no fatal issue
+	Error  string         `json:"error,omitempty"` // that stopped the run
+	Counts map[string]int `json:"counts"`
+	Issues []Issue        `json:"issues"`
+}
+
+var (
+	mu      sync.Mutex
+	current = Report{Start: time.Now(), Counts: make(map[string]int)}
+)
+
+// Start starts a new run, forgetting the last one
+func Start(now time.Time) {
+	mu.Lock()
+	defer mu.Unlock()
+	current = Report{Start: now, Counts: make(map[string]int)}
+}
+
+func add(stage Stage, level, msg string) {
+	mu.Lock()
+	defer mu.Unlock()
+	current.Issues = append(current.Issues, Issue{Stage: stage, Level: level, Message: msg})
+}
+
+// Warn logs and records a warning
+func Warn(stage Stage, msg string) {
+	slog.Warn(msg)
+	add(stage, LevelWarning, msg)
+}
+
+// Error logs and records an error, that the run continues after
+func Error(stage Stage, msg string) {
+	slog.Error(msg)
+	add(stage, LevelError, msg)
+}
+
+// Fatal records an error that stops the run, and gives it back. It is
+// logged by the caller.
+func Fatal(stage Stage, err error) error {
+	add(stage, LevelFatal, err.Error())
+	return err
+}
+
+// Count records a count of something, like trees
+func Count(name string, n int) {
+	mu.Lock()
+	defer mu.Unlock()
+	current.Counts[name] = n
+}
+
+// Finish ends the run, which err stopped if not nil, and gives the report
+// of it
+func Finish(now time.Time, err error) Report {
+	mu.Lock()
+	defer mu.Unlock()
+	current.End = now
+	current.OK = err == nil
+	if err != nil {
+		current.Error = err.Error()
+	}
+	for _, issue := range current.Issues {
+		if issue.Level == LevelFatal {
+			current.OK = false
+		}
+	}
+	r := current
+	r.Issues = append([]Issue{}, current.Issues...)
+	return r
+}
+
+// Errors counts the errors, fatal or not
+func (r Report) Errors() int {
+	n := 0
+	for _, issue := range r.Issues {
+		if issue.Level != LevelWarning {
+			n++
+		}
+	}
+	return n
+}
+
+// Summary describes the run in a line, and the issues per stage in
+// another, if any
+func (r Report) Summary() []string {
+	var counts []string
+	for name, n := range r.Counts {
+		counts = append(counts, fmt.Sprintf("%s %d", name, n))
+	}
+	sort.Strings(counts)
+	line := fmt.Sprintf("Run took %s", r.End.Sub(r.Start).Round(time.Second))
+	if len(counts) > 0 {
+		line += ": " + strings.Join(counts, ", ")
+	}
+	lines := []string{line}
+
+	if len(r.Issues) == 0 {
+		return lines
+	}
+	perStage := make(map[Stage]map[string]int)
+	for _, issue := range r.Issues {
+		if perStage[issue.Stage] == nil {
+			perStage[issue.Stage] = make(map[string]int)
+		}
+		perStage[issue.Stage][issue.Level]++
+	}
+	var stages []string
+	for _, stage := range []Stage{StageDB, StageGeocode, StageImages, StageRender} {
+		levels, ok := perStage[stage]
+		if !ok {
+			continue
+		}
+		var parts []string
+		for _, level := range []string{LevelFatal, LevelError, LevelWarning} {
+			if n := levels[level]; n > 0 {
+				parts = append(parts, fmt.Sprintf("%d %s", n, level))
+			}
+		}
+		stages = append(stages, fmt.Sprintf("%s %s", stage, strings.Join(parts, ", ")))
+	}
+	return append(lines, "Run had issues: "+strings.Join(stages, "; "))
+}
+
+// WriteFile writes the report as JSON
+func (r Report) WriteFile(file string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed Marshal run report: %w", err)
+	}
+	if err = renameio.WriteFile(file, data, 0o644); err != nil {
+		return fmt.Errorf("failed WriteFile: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package taxonomy
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Level is what to group tree types on when counting.
+type Level int
+
+const (
+	// LevelType is the raw (trimmed) type string as found in the database.
+	LevelType Level = iota
+	// LevelSpecies is the canonical species that the raw type maps to.
+	LevelSpecies
+	// LevelCategory is the category of the species (kärnfrukt, stenfrukt...).
+	LevelCategory
+)
+
+//go:embed taxonomy.json
+var defaultTaxonomy []byte
+
+type Taxonomy struct {
+	Species []Species `json:"species"`
+	byType  map[string]*Species
+}
+
+type Species struct {
+	Name     string   `json:"name"`
+	Latin    string   `json:"latin"`
+	Category string   `json:"category"`
+	Types    []string `json:"types"`
+}
+
+// Load reads a taxonomy from a JSON file, or the built-in default if file
+// is empty.
+func Load(file string) (*Taxonomy, error) {
+	data := defaultTaxonomy
+	if file != "" {
+		var err error
+		if data, err = os.ReadFile(file); err != nil {
+			return nil, fmt.Errorf("failed ReadFile: %w", err)
+		}
+	}
+
+	var t Taxonomy
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, fmt.Errorf("failed Unmarshal taxonomy: %w", err)
+	}
+
+	t.byType = make(map[string]*Species)
+	for idx := range t.Species {
+		s := &t.Species[idx]
+		if s.Name == "" {
+			return nil, fmt.Errorf("taxonomy: species %d has no name", idx)
+		}
+		// The canonical name always maps to itself
+		for _, typ := range append([]string{s.Name}, s.Types...) {
+			norm := Normalize(typ)
+			if other, ok := t.byType[norm]; ok && other != s {
+				return nil, fmt.Errorf("taxonomy: type %q maps to both %q and %q",
+					typ, other.Name, s.Name)
+			}
+			t.byType[norm] = s
+		}
+	}
+
+	return &t, nil
+}
+
+// Normalize folds case and whitespace so that "Äpple", "äpple " and
+// "ÄPPLE" are the same type.
+func Normalize(typ string) string {
+	return strings.ToLower(strings.Join(strings.Fields(typ), " "))
+}
+
+// Lookup finds the species that a raw type maps to. Safe to call on a nil
+// Taxonomy, which maps nothing.
+func (t *Taxonomy) Lookup(typ string) (*Species, bool) {
+	if t == nil {
+		return nil, false
+	}
+	s, ok := t.byType[Normalize(typ)]
+	return s, ok
+}
+
+// Key returns what a raw type is grouped under at the given level. Types
+// that are not mapped are grouped under their trimmed raw type, normalized
+// above LevelType like in Lookup, so they are never lost from counts and
+// "Äpple " and "äpple" are one species.
+func (t *Taxonomy) Key(typ string, level Level) string {
+	typ = strings.TrimSpace(typ)
+	if level == LevelType {
+		return typ
+	}
+	s, ok := t.Lookup(typ)
+	if !ok {
+		return Normalize(typ)
+	}
+	if level == LevelCategory {
+		return s.Category
+	}
+	return s.Name
+}
+
+// Latin returns the latin name for a species name, or "" if unknown.
+func (t *Taxonomy) Latin(name string) string {
+	if s, ok := t.Lookup(name); ok && s.Name == name {
+		return s.Latin
+	}
+	return ""
+}
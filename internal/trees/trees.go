@@ -1,18 +1,20 @@
 package trees
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
-	"os"
 	"sort"
 
+	"github.com/fruktkartan/fruktsam/internal/filter"
+	"github.com/fruktkartan/fruktsam/internal/taxonomy"
 	"github.com/fruktkartan/fruktsam/internal/types"
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq" // for sqlx
 )
 
 type Trees struct {
-	entries map[string]*Entry
+	Taxonomy *taxonomy.Taxonomy // for grouping types when counting, may be nil
+	entries  map[string]*Entry
 }
 
 type Entry struct {
@@ -25,7 +27,9 @@ type Entry struct {
 	Lat, Lon sql.NullFloat64
 }
 
-func (t *Trees) FromDB() error {
+// FromDB reads the trees, with db like a transaction shared with the
+// reading of the history.
+func (t *Trees) FromDB(ctx context.Context, db sqlx.QueryerContext) error {
 	if t.entries == nil {
 		t.entries = make(map[string]*Entry)
 	}
@@ -46,11 +50,7 @@ func (t *Trees) FromDB() error {
 
 	var rows []Entry
 
-	db, err := sqlx.Connect("postgres", os.Getenv("DATABASE_URL"))
-	if err != nil {
-		return fmt.Errorf("failed Connect: %w", err)
-	}
-	if err := db.Select(&rows, query); err != nil {
+	if err := sqlx.SelectContext(ctx, db, &rows, query); err != nil {
 		return fmt.Errorf("failed Select: %w", err)
 	}
 
@@ -63,6 +63,35 @@ func (t *Trees) FromDB() error {
 	return nil
 }
 
+// Filter drops the trees that do not pass f.
+func (t *Trees) Filter(f *filter.Filter) {
+	if f.Empty() {
+		return
+	}
+	for key, e := range t.entries {
+		s := filter.Subject{
+			Type:   e.Type.String(),
+			By:     e.By.String(),
+			HasPos: e.Lat.Valid && e.Lon.Valid,
+		}
+		if s.HasPos {
+			s.Pos = types.Pos{Lat: e.Lat.Float64, Lon: e.Lon.Float64}
+		}
+		if !f.Match(s) {
+			delete(t.entries, key)
+		}
+	}
+}
+
+// Copy gives a copy that can be filtered without affecting t
+func (t Trees) Copy() Trees {
+	c := Trees{Taxonomy: t.Taxonomy, entries: make(map[string]*Entry, len(t.entries))}
+	for key, tree := range t.entries {
+		c.entries[key] = tree
+	}
+	return c
+}
+
 func (t Trees) Get(key string) (Entry, bool) {
 	if tree, ok := t.entries[key]; ok {
 		return *tree, true
@@ -70,26 +99,91 @@ func (t Trees) Get(key string) (Entry, bool) {
 	return Entry{}, false
 }
 
+// Entries gives the trees, by key
+func (t Trees) Entries() []Entry {
+	entries := make([]Entry, 0, len(t.entries))
+	for _, e := range t.entries {
+		entries = append(entries, *e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key.String() < entries[j].Key.String()
+	})
+	return entries
+}
+
+// Images gives the names of the images of the trees
+func (t Trees) Images() []string {
+	var images []string
+	for _, e := range t.entries {
+		if img := e.Img.String(); img != "" {
+			images = append(images, img)
+		}
+	}
+	return images
+}
+
+func (t Trees) Has(key string) bool {
+	_, ok := t.entries[key]
+	return ok
+}
+
 func (t Trees) Count() int {
 	return len(t.entries)
 }
 
 type TypeCount struct {
 	Type  string
+	Latin string
 	Count int
 }
 
+// TypeCounts counts trees per raw type.
 func (t Trees) TypeCounts() []TypeCount {
+	return t.CountsBy(taxonomy.LevelType)
+}
+
+// SpeciesCounts counts trees per canonical species in the taxonomy.
+func (t Trees) SpeciesCounts() []TypeCount {
+	return t.CountsBy(taxonomy.LevelSpecies)
+}
+
+// CategoryCounts counts trees per category of species in the taxonomy.
+func (t Trees) CategoryCounts() []TypeCount {
+	return t.CountsBy(taxonomy.LevelCategory)
+}
+
+// UnmappedTypes counts trees per raw type that the taxonomy has no species
+// for.
+func (t Trees) UnmappedTypes() []TypeCount {
+	counts := make(map[string]int)
+	for _, e := range t.entries {
+		if _, ok := t.Taxonomy.Lookup(e.Type.String()); !ok {
+			counts[e.Type.String()]++
+		}
+	}
+	return sortedCounts(counts, nil)
+}
+
+func (t Trees) CountsBy(level taxonomy.Level) []TypeCount {
 	counts := make(map[string]int)
 
 	for _, e := range t.entries {
-		counts[e.Type.String()]++
+		counts[t.Taxonomy.Key(e.Type.String(), level)]++
+	}
+
+	var tx *taxonomy.Taxonomy
+	if level == taxonomy.LevelSpecies {
+		tx = t.Taxonomy
 	}
+	return sortedCounts(counts, tx)
+}
 
+func sortedCounts(counts map[string]int, tx *taxonomy.Taxonomy) []TypeCount {
 	typeCounts := make([]TypeCount, 0, len(counts))
 	for typ, count := range counts {
 		typeCounts = append(typeCounts, TypeCount{
 			Type:  typ,
+			Latin: tx.Latin(typ),
 			Count: count,
 		})
 	}
@@ -3,6 +3,7 @@ package types
 import (
 	"database/sql"
 	"fmt"
+	"html/template"
 	"strconv"
 	"strings"
 
@@ -13,7 +14,7 @@ type NullString struct {
 	sql.NullString
 }
 
-func (ns *NullString) String() string {
+func (ns NullString) String() string {
 	if !ns.NullString.Valid {
 		return ""
 	}
@@ -24,7 +25,7 @@ type NullStringTrimmed struct {
 	sql.NullString
 }
 
-func (ns *NullStringTrimmed) String() string {
+func (ns NullStringTrimmed) String() string {
 	if !ns.NullString.Valid {
 		return ""
 	}
@@ -35,21 +36,21 @@ type NullTime struct {
 	sql.NullTime
 }
 
-func (nt *NullTime) String() string {
+func (nt NullTime) String() string {
 	if !nt.NullTime.Valid {
 		return ""
 	}
 	return util.FormatDateTime(nt.Time)
 }
 
-func (nt *NullTime) Date() string {
+func (nt NullTime) Date() string {
 	if !nt.NullTime.Valid {
 		return ""
 	}
 	return util.FormatDate(nt.Time)
 }
 
-func (nt *NullTime) WeekNumber() string {
+func (nt NullTime) WeekNumber() string {
 	if !nt.NullTime.Valid {
 		return ""
 	}
@@ -57,7 +58,7 @@ func (nt *NullTime) WeekNumber() string {
 	return strconv.Itoa(w)
 }
 
-func (nt *NullTime) TimeStr() string {
+func (nt NullTime) TimeStr() string {
 	if !nt.NullTime.Valid {
 		return ""
 	}
@@ -83,7 +84,8 @@ func (p *Pos) GoogmapsURL() string {
 		p.Lat, p.Lon, p.Lat, p.Lon)
 }
 
-func (p *Pos) GeoURL() string {
-	return fmt.Sprintf("geo:%g,%g",
-		p.Lat, p.Lon)
+// GeoURL is a geo: URL, which html/template would otherwise filter out
+func (p *Pos) GeoURL() template.URL {
+	return template.URL(fmt.Sprintf("geo:%g,%g",
+		p.Lat, p.Lon))
 }
@@ -1,36 +1,103 @@
 package util
 
 import (
+	"fmt"
 	"log"
 	"time"
 
+	"github.com/fruktkartan/fruktsam/internal/i18n"
 	"github.com/goodsign/monday"
 )
 
+const DefaultTimeZone = "Europe/Stockholm"
+
 var location *time.Location
 
-const (
-	mondayLocale = monday.LocaleSvSE
-	dateFmt      = "2006-01-02"
-	timeFmt      = "15:04"
-	dateTimeFmt  = dateFmt + " " + timeFmt
-)
+// locale is how to format times for a language
+type locale struct {
+	monday                                  monday.Locale
+	dateFmt, timeFmt, dateTimeFmt, monthFmt string
+}
+
+var locales = map[string]locale{
+	"sv": {monday.LocaleSvSE, "2006-01-02", "15:04", "2006-01-02 15:04", "January 2006"},
+	"en": {monday.LocaleEnGB, "2 Jan 2006", "15:04", "2 Jan 2006 15:04", "January 2006"},
+}
+
+var loc = locales["sv"]
 
 func init() {
 	var err error
-	if location, err = time.LoadLocation("Europe/Stockholm"); err != nil {
+	if location, err = time.LoadLocation(DefaultTimeZone); err != nil {
 		log.Fatal(err)
 	}
 }
 
+// SetLocation sets the time zone that times are shown in, by IANA name.
+// Empty means the default.
+func SetLocation(name string) error {
+	if name == "" {
+		name = DefaultTimeZone
+	}
+	l, err := time.LoadLocation(name)
+	if err != nil {
+		return fmt.Errorf("failed LoadLocation: %w", err)
+	}
+	location = l
+	return nil
+}
+
+// SetLocale sets how times are formatted, by language. Empty means
+// Swedish.
+func SetLocale(lang string) error {
+	if lang == "" {
+		lang = "sv"
+	}
+	l, ok := locales[lang]
+	if !ok {
+		return fmt.Errorf("no time formats for language %q", lang)
+	}
+	loc = l
+	return nil
+}
+
+// Location is the time zone that times are shown in.
+func Location() *time.Location {
+	return location
+}
+
+// StartOfDay is midnight of the day of t, in Location.
+func StartOfDay(t time.Time) time.Time {
+	t = t.In(location)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, location)
+}
+
 func FormatDate(t time.Time) string {
-	return monday.Format(t.In(location), dateFmt, mondayLocale)
+	return monday.Format(t.In(location), loc.dateFmt, loc.monday)
 }
 
 func FormatTime(t time.Time) string {
-	return monday.Format(t.In(location), timeFmt, mondayLocale)
+	return monday.Format(t.In(location), loc.timeFmt, loc.monday)
 }
 
 func FormatDateTime(t time.Time) string {
-	return monday.Format(t.In(location), dateTimeFmt, mondayLocale)
+	return monday.Format(t.In(location), loc.dateTimeFmt, loc.monday)
+}
+
+func FormatMonth(t time.Time) string {
+	return monday.Format(t.In(location), loc.monthFmt, loc.monday)
+}
+
+// FormatDuration gives a short rough duration, like "3 d 4 h" or "25 min"
+// in Swedish, in the language of i18n.
+func FormatDuration(d time.Duration) string {
+	const day = 24 * time.Hour
+	switch {
+	case d >= day:
+		return i18n.TN("duration.days", int(d/day), int((d%day)/time.Hour))
+	case d >= time.Hour:
+		return i18n.T("duration.hours", int(d/time.Hour), int((d%time.Hour)/time.Minute))
+	default:
+		return i18n.T("duration.minutes", int(d/time.Minute))
+	}
 }
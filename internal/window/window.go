@@ -0,0 +1,238 @@
+package window
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fruktkartan/fruktsam/internal/i18n"
+	"github.com/fruktkartan/fruktsam/internal/util"
+	"github.com/google/renameio/v2"
+)
+
+const markerFile = "lastrun"
+
+// Window is the time range of history to look at. A zero From or To means
+// that end is open.
+type Window struct {
+	From, To time.Time
+	desc     string
+}
+
+// Cond is an SQL condition on column at being in the window. The bounds
+// are parameters $1 and $2, see Args.
+const Cond = `(($1::timestamptz IS NULL OR at >= $1) AND ($2::timestamptz IS NULL OR at < $2))`
+
+// Args are the parameters for Cond
+func (w Window) Args() []any {
+	return []any{nullTime(w.From), nullTime(w.To)}
+}
+
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+func (w Window) Contains(t time.Time) bool {
+	return (w.From.IsZero() || !t.Before(w.From)) && (w.To.IsZero() || t.Before(w.To))
+}
+
+// String describes the window, fitting in "history.during" messages
+func (w Window) String() string {
+	if w.desc != "" {
+		return w.desc
+	}
+	switch {
+	case w.From.IsZero() && w.To.IsZero():
+		return i18n.T("window.all")
+	case w.To.IsZero():
+		return i18n.T("window.since", util.FormatDateTime(w.From))
+	case w.From.IsZero():
+		return i18n.T("window.before", util.FormatDateTime(w.To))
+	}
+	return i18n.T("window.range", util.FormatDateTime(w.From), util.FormatDateTime(w.To))
+}
+
+// Union is the smallest window covering all the windows
+func Union(ws ...Window) Window {
+	var u Window
+	for i, w := range ws {
+		if i == 0 || (!u.From.IsZero() && (w.From.IsZero() || w.From.Before(u.From))) {
+			u.From = w.From
+		}
+		if i == 0 || (!u.To.IsZero() && (w.To.IsZero() || w.To.After(u.To))) {
+			u.To = w.To
+		}
+	}
+	if len(ws) == 1 {
+		u.desc = ws[0].desc
+	}
+	return u
+}
+
+// All is the window without bounds
+func All() Window {
+	return Window{}
+}
+
+// Days is the window from midnight, days days back from today. If days is
+// not positive, the window is unbounded.
+func Days(days int, now time.Time) Window {
+	if days <= 0 {
+		return All()
+	}
+	return Window{
+		From: util.StartOfDay(now).AddDate(0, 0, -days),
+		desc: i18n.T("window.days", days),
+	}
+}
+
+// Range is the window between from and to, either of which may be empty.
+// Accepts dates, like 2026-09-01, and times, like 2026-09-01T12:00. A to
+// date includes that whole day.
+func Range(from, to string) (Window, error) {
+	var w Window
+	var err error
+	fromDate, toDate := true, true
+	if from != "" {
+		if w.From, fromDate, err = parseTime(from); err != nil {
+			return w, fmt.Errorf("from: %w", err)
+		}
+	}
+	if to != "" {
+		if w.To, toDate, err = parseTime(to); err != nil {
+			return w, fmt.Errorf("to: %w", err)
+		}
+		if toDate {
+			w.To = w.To.AddDate(0, 0, 1)
+		}
+	}
+	if !w.From.IsZero() && !w.To.IsZero() && !w.From.Before(w.To) {
+		return w, fmt.Errorf("from %s is not before to %s", from, to)
+	}
+	if fromDate && toDate && !w.From.IsZero() && !w.To.IsZero() {
+		w.desc = i18n.T("window.range", util.FormatDate(w.From),
+			util.FormatDate(w.To.AddDate(0, 0, -1)))
+	}
+	return w, nil
+}
+
+func parseTime(s string) (time.Time, bool, error) {
+	if t, err := time.ParseInLocation("2006-01-02", s, util.Location()); err == nil {
+		return t, true, nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02T15:04:05"} {
+		if t, err := time.ParseInLocation(layout, s, util.Location()); err == nil {
+			return t, false, nil
+		}
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, false, nil
+	}
+	return time.Time{}, false, fmt.Errorf("can't parse %q as date or time", s)
+}
+
+// Week is the ISO week given like 2026-W40
+func Week(s string) (Window, error) {
+	year, week, ok := strings.Cut(s, "-W")
+	if !ok {
+		return Window{}, fmt.Errorf("week %q is not like 2026-W40", s)
+	}
+	y, err := strconv.Atoi(year)
+	if err != nil {
+		return Window{}, fmt.Errorf("week %q: bad year", s)
+	}
+	wk, err := strconv.Atoi(week)
+	if err != nil || wk < 1 || wk > 53 {
+		return Window{}, fmt.Errorf("week %q: bad week number", s)
+	}
+
+	// January 4th is always in week 1
+	jan4 := time.Date(y, time.January, 4, 0, 0, 0, 0, util.Location())
+	monday := jan4.AddDate(0, 0, -((int(jan4.Weekday()) + 6) % 7))
+	from := monday.AddDate(0, 0, 7*(wk-1))
+	if fy, fw := from.ISOWeek(); fy != y || fw != wk {
+		return Window{}, fmt.Errorf("week %q does not exist", s)
+	}
+
+	return Window{
+		From: from,
+		To:   from.AddDate(0, 0, 7),
+		desc: i18n.T("window.week", wk, y),
+	}, nil
+}
+
+// Month is the calendar month given like 2026-09
+func Month(s string) (Window, error) {
+	from, err := time.ParseInLocation("2006-01", s, util.Location())
+	if err != nil {
+		return Window{}, fmt.Errorf("month %q is not like 2026-09", s)
+	}
+	return Window{
+		From: from,
+		To:   from.AddDate(0, 1, 0),
+		desc: util.FormatMonth(from),
+	}, nil
+}
+
+// SinceLastRun is the window since the time in the marker file in dir.
+// Returns false if there is no marker.
+func SinceLastRun(dir string) (Window, bool, error) {
+	data, err := os.ReadFile(filepath.Join(dir, markerFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Window{}, false, nil
+		}
+		return Window{}, false, err
+	}
+	from, err := time.Parse(time.RFC3339, strings.TrimSpace(string(data)))
+	if err != nil {
+		return Window{}, false, fmt.Errorf("marker file: %w", err)
+	}
+	return Window{
+		From: from,
+		desc: i18n.T("window.sincelastrun", util.FormatDateTime(from)),
+	}, true, nil
+}
+
+// SaveMarker records t as the time of the last run, in dir.
+func SaveMarker(dir string, t time.Time) error {
+	return renameio.WriteFile(filepath.Join(dir, markerFile),
+		[]byte(t.Format(time.RFC3339)+"\n"), 0o644)
+}
+
+// Period is a kind of calendar period that history can be split into
+type Period string
+
+const (
+	PeriodWeek  Period = "week"
+	PeriodMonth Period = "month"
+)
+
+func ParsePeriod(s string) (Period, error) {
+	switch p := Period(s); p {
+	case PeriodWeek, PeriodMonth:
+		return p, nil
+	}
+	return "", fmt.Errorf("period %q is not %s or %s", s, PeriodWeek, PeriodMonth)
+}
+
+// SQLKey is an SQL expression giving the key of the period (like 2026-W40
+// or 2026-09) that column at is in. The time zone is parameter $1.
+func (p Period) SQLKey() string {
+	if p == PeriodWeek {
+		return `to_char(at AT TIME ZONE $1, 'IYYY-"W"IW')`
+	}
+	return `to_char(at AT TIME ZONE $1, 'YYYY-MM')`
+}
+
+// Window gives the window of the period with the key
+func (p Period) Window(key string) (Window, error) {
+	if p == PeriodWeek {
+		return Week(key)
+	}
+	return Month(key)
+}
@@ -1,30 +1,39 @@
 package main
 
 import (
-	"bytes"
-	"embed"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"log/slog"
 	"os"
-	"path"
-	"path/filepath"
+	"os/signal"
+	"strconv"
 	"strings"
-	"text/template"
+	"syscall"
 	"time"
 
+	"github.com/fruktkartan/fruktsam/internal/filter"
+	"github.com/fruktkartan/fruktsam/internal/flagtypes"
 	"github.com/fruktkartan/fruktsam/internal/history"
-	"github.com/fruktkartan/fruktsam/internal/trees"
+	"github.com/fruktkartan/fruktsam/internal/i18n"
+	"github.com/fruktkartan/fruktsam/internal/images"
+	"github.com/fruktkartan/fruktsam/internal/metrics"
+	"github.com/fruktkartan/fruktsam/internal/reversecache"
+	"github.com/fruktkartan/fruktsam/internal/runreport"
+	"github.com/fruktkartan/fruktsam/internal/taxonomy"
 	"github.com/fruktkartan/fruktsam/internal/util"
-	"github.com/google/renameio/v2"
+	"github.com/fruktkartan/fruktsam/internal/window"
+	"github.com/jmoiron/sqlx"
 	"github.com/joho/godotenv"
 )
 
-const (
-	envFile = ".env"
-	outFile = "index.html"
-)
+const envFile = ".env"
+
+// timeNow gives the time of a run, which the windows are relative to.
+// Fixed in tests.
+var timeNow = time.Now
 
 // Logging setup with levels, based on slog bridge to classic log.
 // Gives us simple output (not slog `time=... level=FOO msg="..."`).
@@ -36,14 +45,18 @@ func setLogLevel(level slog.Level) {
 	slog.SetLogLoggerLevel(level)
 }
 
-//go:embed tmpl_index.html
-var templates embed.FS
+// exitPartial is the exit code when the run completed with errors, and
+// strict is set
+const exitPartial = 2
+
+// partialError is given by run when it completed with errors, and strict
+// is set
+type partialError struct {
+	errors int
+}
 
-type templateData struct {
-	History      history.History
-	Now          string
-	DatabaseName string
-	Trees        trees.Trees
+func (e partialError) Error() string {
+	return fmt.Sprintf("run completed with %d errors", e.errors)
 }
 
 func main() {
@@ -51,75 +64,380 @@ func main() {
 	log.SetFlags(0)
 	if err := run(); err != nil {
 		slog.Error(err.Error())
+		var pe partialError
+		if errors.As(err, &pe) {
+			os.Exit(exitPartial)
+		}
 		os.Exit(1)
 	}
 	os.Exit(0)
 }
 
-func run() error {
+// finishRun logs the summary of the run and writes the run report, if
+// configured. Gives the error of the run, or partialError.
+func finishRun(cfg *config, runErr error) error {
+	rep := runreport.Finish(time.Now(), runErr)
+	for idx, line := range rep.Summary() {
+		if idx == 0 {
+			slog.Info(line)
+		} else {
+			slog.Warn(line)
+		}
+	}
+
+	metrics.FinishRun(rep)
+	if cfg.MetricsFile != "" {
+		if err := metrics.WriteFile(cfg.MetricsFile); err != nil {
+			slog.Error(fmt.Sprintf("failed write metrics: %s", err))
+		}
+	}
+
+	if cfg.RunJSON != "" {
+		if err := rep.WriteFile(cfg.RunJSON); err != nil {
+			slog.Error(fmt.Sprintf("failed write run report: %s", err))
+		} else {
+			slog.Info(fmt.Sprintf("Wrote %s", cfg.RunJSON))
+		}
+	}
+
+	if runErr == nil && cfg.Strict && rep.Errors() > 0 {
+		return partialError{errors: rep.Errors()}
+	}
+	return runErr
+}
+
+func run() (err error) {
 	var sinceDays int
+	var fromTime, toTime, week, month string
+	var sinceLastRun bool
 	var destDir string
 	var quiet bool
+	var taxonomyFile string
+	var flagTypesFile string
+	var detailTables string
+	var archivePeriod string
+	var configFile string
+	var templateDir string
+	var lang, tz string
+	var compareImages bool
+	var thumbSizes string
+	var imageSource string
+	var gcThumbs bool
+	var gallery bool
+	var runJSON string
+	var metricsFile string
+	var serveAddr string
+	var interval time.Duration
+	var timeout time.Duration
+	var strict bool
+	var maxLookups, maxFetches int
+	var ff filterFlags
 
-	flag.IntVar(&sinceDays, "s", 90, "How many `days` back")
+	flag.IntVar(&sinceDays, "s", defaultDays, "How many `days` back")
+	flag.StringVar(&fromTime, "from", "", "Start of window, `date` or time like 2026-09-01 or 2026-09-01T12:00")
+	flag.StringVar(&toTime, "to", "", "End of window, `date` (inclusive) or time (exclusive)")
+	flag.StringVar(&week, "week", "", "Window is ISO `week`, like 2026-W40")
+	flag.StringVar(&month, "month", "", "Window is calendar `month`, like 2026-09")
+	flag.BoolVar(&sinceLastRun, "since-last-run", false, "Window is since the last successful run (or -s days if none)")
 	flag.StringVar(&destDir, "d", "dist", "Destination `directory`")
 	flag.BoolVar(&quiet, "q", false, "Be quiet, output only warnings and errors")
+	flag.StringVar(&taxonomyFile, "taxonomy", "", "Taxonomy JSON `file` mapping types to species (default built-in)")
+	flag.StringVar(&flagTypesFile, "flagtypes", "", "Flag types JSON `file` with labels (default built-in)")
+	flag.StringVar(&detailTables, "tables", "",
+		"Comma separated `list` of other history tables to show changes of, not just count.\n"+
+			"Fields to show can be given like table:field1:field2, default all.")
+	flag.StringVar(&archivePeriod, "archive", "", "Maintain archive with a page per `period`, week or month")
+	flag.BoolVar(&gallery, "gallery", false,
+		"Make thumbnails of the images of all trees, and a gallery page of them by type and locality")
+	flag.StringVar(&configFile, "config", "",
+		"TOML `file` configuring reports to generate, instead of the flags for a single report")
+	flag.StringVar(&templateDir, "template", "",
+		"`directory` with templates (*.html) overriding or adding to the built-in ones")
+	flag.StringVar(&lang, "lang", i18n.DefaultLang,
+		"`language` of the report: "+strings.Join(i18n.Langs(), ", "))
+	flag.StringVar(&tz, "tz", util.DefaultTimeZone, "`time zone` that times are shown in")
+	flag.BoolVar(&compareImages, "compare-images", false,
+		"Compare changed images of updates, making side by side images and flagging re-uploads")
+	flag.StringVar(&thumbSizes, "thumb-sizes", "130,260",
+		"Comma separated max side `lengths` of thumbnails, the first is shown and the others are for high density screens")
+	flag.StringVar(&imageSource, "images", "",
+		"Where to get images: URL of bucket, `s3` for an S3-compatible endpoint configured by env, or directory\n"+
+			"(default the fruktkartan bucket)")
+	flag.BoolVar(&gcThumbs, "gc-thumbs", false,
+		"Remove thumbnails not used by current trees, the history, or archive pages, and broken ones")
+	flag.StringVar(&runJSON, "run-json", "", "Write a report of the run, with the errors and warnings per stage, to JSON `file`")
+	flag.BoolVar(&strict, "strict", false,
+		fmt.Sprintf("Exit with code %d if the run completed, but with errors (like failed images)", exitPartial))
+	flag.StringVar(&metricsFile, "metrics", "",
+		"Write Prometheus metrics to `file`, like /var/lib/node_exporter/textfile/fruktsam.prom")
+	flag.StringVar(&serveAddr, "serve", "",
+		"Keep running, generating every -interval, and serve Prometheus metrics on /metrics at `address`, like :9101")
+	flag.DurationVar(&interval, "interval", defaultInterval, "`duration` between runs with -serve")
+	flag.DurationVar(&timeout, "timeout", 0, "Stop a run that takes longer than `duration`, like 30m (default no limit)")
+	flag.IntVar(&maxLookups, "max-lookups", defaultMaxLookups,
+		"Max address `lookups` in a run for -municipality and -gallery, the rest are left to later runs")
+	flag.IntVar(&maxFetches, "max-fetches", defaultMaxFetches,
+		"Max image `fetches` in a run for -gallery, the rest are left to later runs")
+	ff.register()
 	flag.Parse()
 
 	if quiet {
 		setLogLevel(slog.LevelWarn)
 	}
 
-	if !path.IsAbs(destDir) {
-		cwd, err := os.Getwd()
-		if err != nil {
-			return fmt.Errorf("failed Getwd: %w", err)
+	var cfg *config
+	if configFile != "" {
+		if cfg, err = loadConfig(configFile); err != nil {
+			return err
+		}
+	} else {
+		cfg = &config{
+			Lang:        lang,
+			TZ:          tz,
+			Taxonomy:    taxonomyFile,
+			FlagTypes:   flagTypesFile,
+			Tables:      detailTables,
+			Compare:     compareImages,
+			Images:      imageSource,
+			GCThumbs:    gcThumbs,
+			RunJSON:     runJSON,
+			Strict:      strict,
+			MaxLookups:  maxLookups,
+			MaxFetches:  maxFetches,
+			MetricsFile: metricsFile,
+			Serve:       serveAddr,
+			Interval:    interval,
+			Timeout:     timeout,
+			Reports: []reportConfig{{
+				Dest:         destDir,
+				From:         fromTime,
+				To:           toTime,
+				Week:         week,
+				Month:        month,
+				SinceLastRun: sinceLastRun,
+				Archive:      archivePeriod,
+				Gallery:      gallery,
+				Template:     templateDir,
+				Filter:       ff.config(),
+			}},
+		}
+		for _, s := range filter.List(thumbSizes) {
+			var size int
+			if size, err = strconv.Atoi(s); err != nil {
+				return fmt.Errorf("flag -thumb-sizes: %w", err)
+			}
+			cfg.Thumbs = append(cfg.Thumbs, size)
 		}
-		destDir = filepath.Join(cwd, destDir)
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "s" {
+				cfg.Reports[0].Days = &sinceDays
+			}
+		})
+	}
+	if err = cfg.check(); err != nil {
+		return fmt.Errorf("config: %w", err)
 	}
 
-	if err := godotenv.Load(envFile); err != nil && !os.IsNotExist(err) {
+	if err = i18n.Set(cfg.Lang); err != nil {
+		return err
+	}
+	if err = util.SetLocale(cfg.Lang); err != nil {
+		return err
+	}
+	if err = util.SetLocation(cfg.TZ); err != nil {
+		return err
+	}
+
+	if len(cfg.Thumbs) > 0 {
+		history.ThumbSizes = cfg.Thumbs
+	}
+
+	if err = registerTableRenderers(cfg.Tables); err != nil {
+		return err
+	}
+
+	if err = godotenv.Load(envFile); err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("failed load file %s: %w", envFile, err)
 	}
 
-	var data templateData
-	var err error
-	data.DatabaseName, err = getDatabaseName(os.Getenv("DATABASE_URL"))
+	imgSrc, err := images.ParseSource(cfg.Images)
+	if err != nil {
+		return err
+	}
+
+	dbURL := os.Getenv("DATABASE_URL")
+	if _, err = getDatabaseName(dbURL); err != nil {
+		return err
+	}
+	db, err := openDB(dbURL)
 	if err != nil {
 		return err
 	}
-	data.Now = util.FormatDateTime(time.Now())
+	defer db.Close()
+
+	// Stop on Ctrl-C or kill, but save what has been done
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if cfg.Serve != "" {
+		return serve(ctx, cfg, db, imgSrc)
+	}
+	return runOnce(ctx, cfg, db, imgSrc)
+}
+
+// runOnce generates the reports
+func runOnce(ctx context.Context, cfg *config, db *sqlx.DB, imgSrc images.Source) (err error) {
+	runreport.Start(time.Now())
+	metrics.StartRun()
+	defer func() {
+		err = finishRun(cfg, err)
+	}()
 
-	if err = data.Trees.FromDB(); err != nil {
-		return fmt.Errorf("failed Trees.FromDB: %w", err)
+	if cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Timeout)
+		defer cancel()
 	}
-	slog.Info(fmt.Sprintf("Trees: %d", data.Trees.Count()))
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			err = fmt.Errorf("interrupted: %w", err)
+		}
+	}()
 
-	if err = data.History.FromDB(sinceDays, destDir); err != nil {
-		return fmt.Errorf("failed History.FromDB: %w", err)
+	rr := reportRun{now: timeNow(), cacheDir: cfg.CacheDir, maxFetches: cfg.MaxFetches}
+	if rr.databaseName, err = getDatabaseName(os.Getenv("DATABASE_URL")); err != nil {
+		return err
 	}
-	slog.Info(fmt.Sprintf("History entries during past %d days: %d", sinceDays, data.History.Count()))
 
-	tmpl, err := template.ParseFS(templates, "tmpl_index.html")
+	tx, err := taxonomy.Load(cfg.Taxonomy)
 	if err != nil {
-		return fmt.Errorf("failed template ParseFS: %w", err)
+		return fmt.Errorf("failed taxonomy.Load: %w", err)
+	}
+
+	if rr.flagTypes, err = flagtypes.Load(cfg.FlagTypes); err != nil {
+		return fmt.Errorf("failed flagtypes.Load: %w", err)
 	}
 
-	if err = os.MkdirAll(destDir, 0o755); err != nil {
+	if err = os.MkdirAll(cfg.CacheDir, 0o755); err != nil {
 		return fmt.Errorf("failed MkdirAll: %w", err)
 	}
+	rc, err := reversecache.NewReverseCache(cfg.CacheDir)
+	if err != nil {
+		return err
+	}
+	rr.reverseCache = rc
+	rr.places = &lookupPlaces{ctx: ctx, rc: rc, max: cfg.MaxLookups}
+	defer func() {
+		if saveErr := rc.Save(); saveErr != nil {
+			runreport.Error(runreport.StageGeocode, fmt.Sprintf("failed reversecache.Save: %s", saveErr))
+		}
+	}()
 
-	var buf bytes.Buffer
-	if err = tmpl.Execute(&buf, &data); err != nil {
-		return fmt.Errorf("failed template Execute: %w", err)
+	// Read all from the same snapshot of the database
+	dbStart := time.Now()
+	dbTx, err := beginSnapshot(ctx, db)
+	if err != nil {
+		return runreport.Fatal(runreport.StageDB, err)
 	}
+	defer func() {
+		_ = dbTx.Rollback() // no-op if committed
+	}()
 
-	outFile := filepath.Join(destDir, outFile)
-	if err = renameio.WriteFile(outFile, buf.Bytes(), 0o644); err != nil {
-		return fmt.Errorf("failed WriteFile: %w", err)
+	reports := make([]*report, 0, len(cfg.Reports))
+	periods := make(map[window.Period][]history.PeriodStat)
+	tmpls := make(templateSet)
+	for _, rcfg := range cfg.Reports {
+		r := &report{reportConfig: rcfg}
+		if r.window, err = r.reportConfig.window(rr.now); err != nil {
+			return err
+		}
+		if r.tmpl, err = tmpls.get(r.Template); err != nil {
+			return fmt.Errorf("report %s: %w", r.Name, err)
+		}
+		if r.filter, err = r.Filter.build(tx, rr.places); err != nil {
+			return fmt.Errorf("report %s: filter: %w", r.Name, err)
+		}
+		if err = openArchive(ctx, dbTx, cfg, r, periods); err != nil {
+			return err
+		}
+		reports = append(reports, r)
+	}
+
+	rr.trees.Taxonomy = tx
+	if err = rr.trees.FromDB(ctx, dbTx); err != nil {
+		return runreport.Fatal(runreport.StageDB, fmt.Errorf("failed Trees.FromDB: %w", err))
+	}
+	slog.Info(fmt.Sprintf("Trees: %d", rr.trees.Count()))
+	// By species, as there is no end to the raw types
+	speciesCounts := make(map[string]int)
+	for _, tc := range rr.trees.SpeciesCounts() {
+		species := tc.Type
+		if _, ok := tx.Lookup(species); !ok {
+			species = "other"
+		}
+		speciesCounts[species] += tc.Count
+	}
+	for species, count := range speciesCounts {
+		metrics.Trees.Set(float64(count), species)
+	}
+	runreport.Count("trees", rr.trees.Count())
+	if unmapped := rr.trees.UnmappedTypes(); len(unmapped) > 0 {
+		slog.Info(fmt.Sprintf("Types not in taxonomy: %d", len(unmapped)))
 	}
-	slog.Info(fmt.Sprintf("Wrote %s", outFile))
 
+	win, err := coveringWindow(reports)
+	if err != nil {
+		return err
+	}
+	rr.history = &history.History{
+		Taxonomy:      tx,
+		FlagTypes:     rr.flagTypes,
+		ReverseCache:  rc,
+		CompareImages: cfg.Compare,
+		Images:        imgSrc,
+	}
+	if err = rr.history.FromDB(ctx, dbTx, win); err != nil {
+		return runreport.Fatal(runreport.StageDB, fmt.Errorf("failed History.FromDB: %w", err))
+	}
+	if err = dbTx.Commit(); err != nil {
+		return runreport.Fatal(runreport.StageDB, fmt.Errorf("failed Commit: %w", err))
+	}
+	metrics.TimeStage(runreport.StageDB, dbStart)
+	if err = rr.history.Prepare(ctx, cfg.CacheDir); err != nil {
+		return fmt.Errorf("failed History.Prepare: %w", err)
+	}
+	slog.Info(fmt.Sprintf("History entries during %s: %d", win, rr.history.Count()))
+	runreport.Count("history_entries", rr.history.Count())
+
+	for _, r := range reports {
+		if err = rr.generate(ctx, r); err != nil {
+			return runreport.Fatal(runreport.StageRender, fmt.Errorf("report %s: %w", r.Name, err))
+		}
+	}
+	runreport.Count("reports", len(reports))
+
+	if cfg.GCThumbs {
+		if err = rr.gcThumbs(reports); err != nil {
+			return runreport.Fatal(runreport.StageImages, err)
+		}
+	} else if err = rr.logImageUsage(); err != nil {
+		runreport.Warn(runreport.StageImages, err.Error())
+	}
+
+	return nil
+}
+
+func registerTableRenderers(tables string) error {
+	for _, spec := range strings.Split(tables, ",") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+		parts := strings.Split(spec, ":")
+		r := history.FieldsRenderer{Fields: parts[1:]}
+		if err := history.RegisterRenderer(parts[0], r); err != nil {
+			return fmt.Errorf("tables: %w", err)
+		}
+	}
 	return nil
 }
 
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fruktkartan/fruktsam/internal/archive"
+	"github.com/fruktkartan/fruktsam/internal/filter"
+	"github.com/fruktkartan/fruktsam/internal/flagtypes"
+	"github.com/fruktkartan/fruktsam/internal/history"
+	"github.com/fruktkartan/fruktsam/internal/metrics"
+	"github.com/fruktkartan/fruktsam/internal/reversecache"
+	"github.com/fruktkartan/fruktsam/internal/runreport"
+	"github.com/fruktkartan/fruktsam/internal/trees"
+	"github.com/fruktkartan/fruktsam/internal/util"
+	"github.com/fruktkartan/fruktsam/internal/window"
+	"github.com/google/renameio/v2"
+)
+
+const (
+	outFile    = "index.html"
+	searchFile = "search.json"
+)
+
+// templateData is the data of the main page, see TEMPLATES.md
+type templateData struct {
+	History      *history.History
+	Now          string
+	DatabaseName string
+	Trees        trees.Trees
+	FlagTypes    *flagtypes.FlagTypes
+	Base         string // relative path to destDir from the page
+	ArchiveURL   string // empty if no archive
+	GalleryURL   string // empty if no gallery
+	SearchURL    string
+	Filter       string // description of filter, empty if none
+}
+
+// report is one report to generate in a run
+type report struct {
+	reportConfig
+	tmpl    *template.Template
+	window  window.Window
+	filter  *filter.Filter
+	archive *archive.Archive
+	stale   []history.PeriodStat // archive pages to generate
+}
+
+// reportRun is what is shared by the reports of a run
+type reportRun struct {
+	now          time.Time
+	databaseName string
+	cacheDir     string
+	reverseCache *reversecache.ReverseCache
+	places       *lookupPlaces
+	fetches      int // of images for galleries, at most maxFetches
+	maxFetches   int
+	flagTypes    *flagtypes.FlagTypes
+	trees        trees.Trees      // all trees
+	history      *history.History // covering the windows of all reports
+}
+
+// coveringWindow gives a window covering the windows of all the reports, and the
+// archive pages that they need to generate.
+func coveringWindow(reports []*report) (window.Window, error) {
+	var ws []window.Window
+	for _, r := range reports {
+		ws = append(ws, r.window)
+		if len(r.stale) > 0 {
+			span, err := r.archive.Span(r.stale)
+			if err != nil {
+				return window.Window{}, err
+			}
+			ws = append(ws, span)
+		}
+	}
+	return window.Union(ws...), nil
+}
+
+func (rr *reportRun) generate(ctx context.Context, r *report) error {
+	t := rr.trees.Copy()
+	t.Filter(r.filter)
+
+	h := rr.history.Sub(r.window)
+	h.Filter(r.filter, t.Has)
+	if err := rr.places.Err(); err != nil {
+		return err
+	}
+	slog.Info(fmt.Sprintf("Report %s: %d trees, %d history entries during %s",
+		r.Name, t.Count(), h.Count(), r.window))
+	metrics.Changes.Set(float64(h.Inserts), r.Name, "insert")
+	metrics.Changes.Set(float64(h.Deletes), r.Name, "delete")
+	metrics.Changes.Set(float64(h.Updates), r.Name, "update")
+
+	if err := os.MkdirAll(r.Dest, 0o755); err != nil {
+		return fmt.Errorf("failed MkdirAll: %w", err)
+	}
+
+	data := templateData{
+		History:      h,
+		Now:          util.FormatDateTime(rr.now),
+		DatabaseName: rr.databaseName,
+		Trees:        t,
+		FlagTypes:    rr.flagTypes,
+		Filter:       r.filter.String(),
+	}
+
+	images := h.ImageFiles()
+
+	if r.archive != nil {
+		archiveImages, err := rr.writeArchive(r, t)
+		if err != nil {
+			return fmt.Errorf("failed writeArchive: %w", err)
+		}
+		images = append(images, archiveImages...)
+		data.ArchiveURL = archive.Dir + "/" + archive.IndexFile
+	}
+
+	if r.Gallery {
+		galleryImages, err := rr.writeGallery(ctx, r, t)
+		if err != nil {
+			return fmt.Errorf("failed writeGallery: %w", err)
+		}
+		images = append(images, galleryImages...)
+		data.GalleryURL = galleryFile
+	}
+
+	// Lookups for the gallery stop when interrupted, leaving it incomplete
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := writeSearchIndex(h, filepath.Join(r.Dest, searchFile)); err != nil {
+		return err
+	}
+	data.SearchURL = searchFile
+
+	if err := renderFile(r.tmpl, "tmpl_index.html", &data, filepath.Join(r.Dest, outFile)); err != nil {
+		return err
+	}
+
+	if r.Dest != rr.cacheDir {
+		if err := linkFiles(rr.cacheDir, r.Dest, images); err != nil {
+			return fmt.Errorf("failed linkFiles: %w", err)
+		}
+	}
+
+	// Not marked as run if interrupted meanwhile, so that the next run
+	// covers the window again
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := window.SaveMarker(r.Dest, rr.now); err != nil {
+		return fmt.Errorf("failed SaveMarker: %w", err)
+	}
+
+	return nil
+}
+
+func renderFile(tmpl *template.Template, name string, data any, outFile string) error {
+	defer metrics.TimeStage(runreport.StageRender, time.Now())
+
+	var buf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&buf, name, data); err != nil {
+		return fmt.Errorf("failed template Execute: %w", err)
+	}
+
+	if err := renameio.WriteFile(outFile, buf.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("failed WriteFile: %w", err)
+	}
+	slog.Info(fmt.Sprintf("Wrote %s", outFile))
+	return nil
+}
+
+func writeSearchIndex(h *history.History, outFile string) error {
+	defer metrics.TimeStage(runreport.StageRender, time.Now())
+
+	b, err := json.Marshal(h.SearchIndex())
+	if err != nil {
+		return fmt.Errorf("failed Marshal search index: %w", err)
+	}
+	if err = renameio.WriteFile(outFile, b, 0o644); err != nil {
+		return fmt.Errorf("failed WriteFile: %w", err)
+	}
+	slog.Info(fmt.Sprintf("Wrote %s", outFile))
+	return nil
+}
+
+// linkFiles makes the files (relative paths) in srcDir available in
+// destDir, by hard link if possible, else by copy. Files already in
+// destDir are replaced if they are not the same as in srcDir, like when a
+// broken thumbnail or a placeholder has been made anew there.
+func linkFiles(srcDir, destDir string, files []string) error {
+	for _, file := range files {
+		src := filepath.Join(srcDir, file)
+		dest := filepath.Join(destDir, file)
+		srcInfo, err := os.Stat(src)
+		if errors.Is(err, os.ErrNotExist) {
+			// Failed to create it, already logged
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if destInfo, statErr := os.Stat(dest); statErr == nil && sameFile(srcInfo, destInfo) {
+			continue
+		}
+		if err = os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+			return err
+		}
+		if err = linkReplace(src, dest); err == nil {
+			continue
+		}
+		if err = copyFile(src, dest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sameFile tells if dest is a hard link to src, or a copy of it that is
+// not older
+func sameFile(src, dest os.FileInfo) bool {
+	return os.SameFile(src, dest) ||
+		(src.Size() == dest.Size() && !src.ModTime().After(dest.ModTime()))
+}
+
+// linkReplace hard links src to dest, replacing dest if it exists
+func linkReplace(src, dest string) error {
+	tmp := fmt.Sprintf("%s.%d.tmp", dest, os.Getpid())
+	if err := os.Link(src, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := renameio.NewPendingFile(dest, renameio.WithPermissions(0o644))
+	if err != nil {
+		return err
+	}
+	defer out.Cleanup()
+
+	if _, err = io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.CloseAtomicallyReplace()
+}
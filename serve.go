@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/fruktkartan/fruktsam/internal/images"
+	"github.com/fruktkartan/fruktsam/internal/metrics"
+	"github.com/jmoiron/sqlx"
+)
+
+// serve generates the reports every interval, serving the metrics on
+// /metrics in between, until ctx is done. Failed runs are logged, and
+// tried again next time.
+func serve(ctx context.Context, cfg *config, db *sqlx.DB, imgSrc images.Source) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	server := &http.Server{Addr: cfg.Serve, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+	slog.Info(fmt.Sprintf("Serving metrics on %s/metrics, generating every %s", cfg.Serve, cfg.Interval))
+
+	for {
+		if err := runOnce(ctx, cfg, db, imgSrc); err != nil {
+			slog.Error(err.Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			slog.Info("Stopping")
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			return server.Shutdown(shutdownCtx)
+		case err := <-serverErr:
+			if errors.Is(err, http.ErrServerClosed) {
+				return nil
+			}
+			return fmt.Errorf("failed ListenAndServe: %w", err)
+		case <-time.After(cfg.Interval):
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"html/template"
+	"path/filepath"
+	"strings"
+
+	"github.com/fruktkartan/fruktsam/internal/i18n"
+)
+
+//go:embed tmpl_*.html
+var templates embed.FS
+
+const treeURLFmt = "https://fruktkartan.se/#/t/%s"
+
+// templateFuncs are the helper funcs available in templates, see
+// TEMPLATES.md
+var templateFuncs = template.FuncMap{
+	"treeURL": func(key string) string {
+		return fmt.Sprintf(treeURLFmt, key)
+	},
+	"t":        i18n.T,
+	"tn":       i18n.TN,
+	"lang":     i18n.Lang,
+	"messages": i18n.Messages,
+	"opLabel": func(op string) string {
+		return i18n.T("op." + op)
+	},
+	"opClass": func(op string) string {
+		return strings.ToLower(op)
+	},
+	"plural": func(n int, one, many string) string {
+		if n == 1 {
+			return one
+		}
+		return many
+	},
+	"pct": func(part, whole int) string {
+		if whole == 0 {
+			return "–"
+		}
+		return fmt.Sprintf("%.0f%%", 100*float64(part)/float64(whole))
+	},
+	"add":   func(a, b int) int { return a + b },
+	"join":  strings.Join,
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+}
+
+// templateSet parses the templates once per template directory
+type templateSet map[string]*template.Template
+
+// get gives the built-in templates, overridden and added to by the *.html
+// files in dir, if not empty. A file overrides the built-in one with the
+// same name, and a {{ define }} in it overrides the partial with that name.
+func (ts templateSet) get(dir string) (*template.Template, error) {
+	if tmpl, ok := ts[dir]; ok {
+		return tmpl, nil
+	}
+
+	tmpl, err := template.New("").Funcs(templateFuncs).ParseFS(templates, "tmpl_*.html")
+	if err != nil {
+		return nil, fmt.Errorf("failed template ParseFS: %w", err)
+	}
+	if dir != "" {
+		if tmpl, err = tmpl.ParseGlob(filepath.Join(dir, "*.html")); err != nil {
+			return nil, fmt.Errorf("failed template ParseGlob: %w", err)
+		}
+	}
+
+	ts[dir] = tmpl
+	return tmpl, nil
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fruktkartan/fruktsam/internal/flagtypes"
+	"github.com/fruktkartan/fruktsam/internal/history"
+	"github.com/fruktkartan/fruktsam/internal/reversecache"
+	"github.com/fruktkartan/fruktsam/internal/taxonomy"
+	"github.com/fruktkartan/fruktsam/internal/types"
+	"github.com/fruktkartan/fruktsam/internal/window"
+	"github.com/jmoiron/sqlx"
+)
+
+// TestFlaggedList runs the script of the page with node, against an API
+// giving a flagged tree with HTML in all its values (see
+// testdata/flagged/run.js), and checks that the HTML is only shown as text.
+func TestFlaggedList(t *testing.T) {
+	node, err := exec.LookPath("node")
+	if err != nil {
+		t.Skip("skipping, no node to run the script of the page")
+	}
+	const payload = "<img src=x onerror=alert(1)>"
+
+	tmpl, err := make(templateSet).get("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ft, err := flagtypes.Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	data := templateData{History: &history.History{}, FlagTypes: ft}
+	if err = tmpl.ExecuteTemplate(&buf, "tmpl_index.html", &data); err != nil {
+		t.Fatal(err)
+	}
+	page := buf.String()
+	start, end := strings.Index(page, "<script>"), strings.Index(page, "</script>")
+	if start < 0 || end < start {
+		t.Fatal("no script in page")
+	}
+	script := filepath.Join(t.TempDir(), "index.js")
+	if err = os.WriteFile(script, []byte(page[start+len("<script>"):end]), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := exec.Command(node, "testdata/flagged/run.js", script).Output()
+	if err != nil {
+		t.Fatalf("failed node: %s", err)
+	}
+	var got struct {
+		InnerHTML []string
+		Tags      []string
+		Texts     []string
+		Attrs     []string
+		Buttons   []struct{ Class, Tree, Flag string }
+		FlagURL   string
+	}
+	if err = json.Unmarshal(out, &got); err != nil {
+		t.Fatalf("failed Unmarshal %s: %s", out, err)
+	}
+
+	if len(got.InnerHTML) > 0 {
+		t.Errorf("innerHTML was set: %q", got.InnerHTML)
+	}
+	// type, flag, reason, flagged by and description
+	if n := strings.Count(strings.Join(got.Texts, "\n"), payload); n != 5 {
+		t.Errorf("payload shown as text %d times, want 5: %q", n, got.Texts)
+	}
+	if n := slices.Index(got.Tags, "img"); n < 0 || slices.Index(got.Tags[n+1:], "img") >= 0 {
+		t.Errorf("want only the photo as img, got tags %q", got.Tags)
+	}
+	for _, attr := range got.Attrs {
+		if strings.Contains(attr, payload) && !strings.HasPrefix(attr, "span.title=") {
+			t.Errorf("payload in attribute %q", attr)
+		}
+	}
+	if len(got.Buttons) != 2 {
+		t.Fatalf("want 2 buttons, got %v", got.Buttons)
+	}
+	for _, b := range got.Buttons {
+		if b.Tree != payload || b.Flag != payload {
+			t.Errorf("button %q carries tree %q and flag %q, want the payload", b.Class, b.Tree, b.Flag)
+		}
+	}
+	if want := "https://fruktkartan.se/api/flag/%3Cimg%20src%3Dx%20onerror%3Dalert(1)%3E/%3Cimg%20src%3Dx%20onerror%3Dalert(1)%3E"; got.FlagURL != want {
+		t.Errorf("flag URL %q, want %q", got.FlagURL, want)
+	}
+}
+
+// TestRenderEntries renders the page with a history of an entry of each
+// op and a flag, read by History.FromDB from historyRows
+func TestRenderEntries(t *testing.T) {
+	dest := t.TempDir()
+
+	// The address of the inserted tree, not to look it up
+	rc, err := reversecache.NewReverseCache(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Table[types.Pos{Lat: 55.6, Lon: 13}] = []byte(`{"address": {"road": "Storgatan", "city": "Malmö", "country_code": "se"}}`)
+
+	tx, err := taxonomy.Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ft, err := flagtypes.Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &history.History{Taxonomy: tx, FlagTypes: ft, ReverseCache: rc}
+	db := sqlx.NewDb(sql.OpenDB(historyRows{}), "postgres")
+	defer db.Close()
+	if err = h.FromDB(context.Background(), db, window.All()); err != nil {
+		t.Fatal(err)
+	}
+	if err = h.Prepare(context.Background(), dest); err != nil {
+		t.Fatal(err)
+	}
+	h = h.Sub(window.All())
+
+	tmpl, err := make(templateSet).get("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	data := templateData{History: h, FlagTypes: ft}
+	if err = tmpl.ExecuteTemplate(&buf, "tmpl_index.html", &data); err != nil {
+		t.Fatal(err)
+	}
+	page := buf.String()
+
+	// Of the insert and of the flag
+	if n := strings.Count(page, `href="https://fruktkartan.se/#/t/ins1"`); n != 2 {
+		t.Errorf("page links %d times to the inserted tree, want 2", n)
+	}
+	if !strings.Contains(page, `href="https://fruktkartan.se/#/t/upd1"`) {
+		t.Error("page does not link to the updated tree")
+	}
+
+	// The values are shown by String, not as structs
+	if strings.Contains(page, " true}") || strings.Contains(page, " false}") {
+		t.Error("page shows a value as a struct")
+	}
+	for _, want := range []string{
+		`<span class="type">` + "\n        " + `<a href="https://fruktkartan.se/#/t/ins1" target="_blank" rel="noopener">Äpple</a>`,
+		"Ett gott äpple", "anna", "Storgatan, Malmö", // insert
+		"Mycket stort", "bertil", // update
+		"Plommon", "[del1]", "Borta", // delete
+		"[ins1]", "Finns inte", "david", // flag
+		"2026-09-10 14:00", // the time of the insert and the flag, in Stockholm
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("page has no %q", want)
+		}
+	}
+}
+
+// historyRows is a database/sql driver giving rows of history for the
+// queries of History.FromDB: an entry of each op on trees, and a flag
+type historyRows struct{}
+
+var (
+	historyAt = time.Date(2026, 9, 10, 12, 0, 0, 0, time.UTC)
+
+	treeColumns = []string{
+		"changeid", "changeat", "changeop",
+		"key", "type", "desc", "img", "by", "at", "lat", "lon",
+		"keynew", "typenew", "descnew", "imgnew", "bynew", "atnew", "latnew", "lonnew",
+	}
+	treeRows = [][]driver.Value{
+		{int64(1), historyAt, "INSERT",
+			nil, nil, nil, nil, nil, nil, nil, nil,
+			"ins1", "Äpple ", "Ett gott äpple", nil, "anna", historyAt, "55.6", "13"},
+		{int64(2), historyAt.Add(time.Hour), "UPDATE",
+			"upd1", "Päron", "Stort", nil, "bertil", historyAt, nil, nil,
+			"upd1", "Päron", "Mycket stort", nil, "bertil", historyAt, nil, nil},
+		{int64(3), historyAt.Add(2 * time.Hour), "DELETE",
+			"del1", "Plommon", "Borta", nil, "cecilia", historyAt, nil, nil,
+			nil, nil, nil, nil, nil, nil, nil, nil},
+	}
+
+	flagColumns = []string{"changeid", "changeat", "changeop", "treekey", "type", "reason", "by", "flaggedat"}
+	flagRows    = [][]driver.Value{
+		{int64(4), historyAt, "INSERT", "ins1", "delete", "Finns inte", "david", historyAt},
+	}
+)
+
+func (historyRows) Open(string) (driver.Conn, error) {
+	return historyRows{}, nil
+}
+
+func (historyRows) Prepare(query string) (driver.Stmt, error) {
+	return historyStmt(query), nil
+}
+
+func (historyRows) Close() error {
+	return nil
+}
+
+func (historyRows) Begin() (driver.Tx, error) {
+	return nil, driver.ErrSkip
+}
+
+// Connect and Driver make historyRows a driver.Connector, for sql.OpenDB
+func (historyRows) Connect(context.Context) (driver.Conn, error) {
+	return historyRows{}, nil
+}
+
+func (hr historyRows) Driver() driver.Driver {
+	return hr
+}
+
+type historyStmt string
+
+func (historyStmt) Close() error {
+	return nil
+}
+
+func (historyStmt) NumInput() int {
+	return -1
+}
+
+func (historyStmt) Exec([]driver.Value) (driver.Result, error) {
+	return nil, driver.ErrSkip
+}
+
+func (q historyStmt) Query([]driver.Value) (driver.Rows, error) {
+	switch {
+	case strings.Contains(string(q), "tab='trees'"):
+		return &fixedRows{columns: treeColumns, rows: treeRows}, nil
+	case strings.Contains(string(q), "tab='flags'"):
+		return &fixedRows{columns: flagColumns, rows: flagRows}, nil
+	}
+	// other tables
+	return &fixedRows{columns: []string{"tab", "changeop", "changeat"}}, nil
+}
+
+type fixedRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *fixedRows) Columns() []string {
+	return r.columns
+}
+
+func (r *fixedRows) Close() error {
+	return nil
+}
+
+func (r *fixedRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
@@ -0,0 +1,90 @@
+// Runs the script of index.html, given as argument, with a minimal DOM and
+// the API stubbed to give a flagged tree with HTML in all its values. Prints
+// what the list of flagged trees became, as JSON. Used by TestFlaggedList.
+'use strict';
+
+const fs = require('fs');
+const vm = require('vm');
+
+const payload = '<img src=x onerror=alert(1)>';
+
+// Everything ever assigned to innerHTML
+const innerHTML = [];
+
+class Text {
+  constructor(s) {
+    this.text = String(s);
+  }
+}
+
+class Element {
+  constructor(tag) {
+    this.tag = tag;
+    this.className = '';
+    this.dataset = {};
+    this.children = [];
+  }
+  append(...children) {
+    for (const c of children) {
+      this.children.push(c instanceof Element ? c : new Text(c));
+    }
+  }
+  replaceChildren(...children) {
+    this.children = [];
+    this.append(...children);
+  }
+  set textContent(s) {
+    this.children = [new Text(s)];
+  }
+  set innerHTML(s) {
+    innerHTML.push(s);
+    this.children = [new Text(s)];
+  }
+  addEventListener() {}
+}
+
+const flagged = new Element('div');
+globalThis.window = globalThis;
+globalThis.document = {
+  getElementById: (id) => (id === 'flagged' ? flagged : new Element('div')),
+  createElement: (tag) => new Element(tag),
+  querySelectorAll: () => [],
+};
+globalThis.fetch = async (url) => ({
+  json: async () => {
+    if (url.endsWith('/flags')) {
+      return [{tree: payload, flag: payload, reason: payload, flagged_by: payload,
+               flagged_at: '2026-09-25T08:00:00Z'}];
+    }
+    return {type: payload, desc: payload, file: payload, added: '2026-09-01T08:00:00Z'};
+  },
+});
+
+vm.runInThisContext(fs.readFileSync(process.argv[2], 'utf8'));
+
+(async () => {
+  await loadFlagged();
+
+  const out = {innerHTML, tags: [], texts: [], attrs: [], buttons: [],
+               flagURL: treeURL(payload, payload)};
+  const walk = (e) => {
+    out.tags.push(e.tag);
+    for (const [k, v] of Object.entries(e)) {
+      if (!['tag', 'className', 'dataset', 'children'].includes(k)) {
+        out.attrs.push(`${e.tag}.${k}=${v}`);
+      }
+    }
+    if (e.tag === 'button') {
+      out.buttons.push({class: e.className, tree: e.dataset.tree, flag: e.dataset.flag});
+    }
+    for (const c of e.children) {
+      if (c instanceof Element) {
+        walk(c);
+      } else if (c.text.trim() !== '') {
+        out.texts.push(c.text);
+      }
+    }
+  };
+  walk(flagged);
+  console.log(JSON.stringify(out));
+})();
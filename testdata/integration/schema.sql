@@ -0,0 +1,35 @@
+-- Stand-in for the fruktkartan schema, without PostGIS: the point column
+-- is a native point (x is lon, y is lat), with the ST_X and ST_Y that
+-- fruktsam uses defined over it.
+
+CREATE FUNCTION ST_X(point) RETURNS double precision
+    AS 'SELECT $1[0]' LANGUAGE SQL IMMUTABLE;
+CREATE FUNCTION ST_Y(point) RETURNS double precision
+    AS 'SELECT $1[1]' LANGUAGE SQL IMMUTABLE;
+
+CREATE TABLE trees (
+    ssm_key     text PRIMARY KEY,
+    type        text,
+    description text,
+    img         text,
+    added_by    text,
+    added_at    timestamp,
+    point       point
+);
+
+CREATE TABLE flags (
+    tree       text REFERENCES trees (ssm_key) ON DELETE CASCADE,
+    flag       text,
+    reason     text,
+    flagged_by text,
+    flagged_at timestamp
+);
+
+CREATE TABLE history (
+    id       serial PRIMARY KEY,
+    at       timestamptz NOT NULL,
+    op       text NOT NULL,
+    tab      text NOT NULL,
+    old_json jsonb,
+    new_json jsonb
+);
@@ -0,0 +1,35 @@
+-- Fixture trees and history. The window of the test is 2026-09, the
+-- August changes are only in the archive.
+
+INSERT INTO trees VALUES
+    ('a1', 'Äppelträd', 'Stort träd vid lekplatsen', 'a1img', 'anna', '2026-08-14 10:00', '(13.0038,55.6050)'),
+    ('p2', 'Päronträd', 'Söta päron i oktober', 'p2img2', 'bertil', '2026-09-02 09:30', '(11.9746,57.7089)'),
+    ('k3', 'Körsbärsträd', '', NULL, 'cecilia', '2026-09-10 18:15', '(18.0686,59.3293)'),
+    ('x4', 'Okänd frukt', 'Vet inte vad det är', 'x4img', 'anna', '2026-09-20 12:00', '(14.5000,63.1800)');
+
+INSERT INTO flags VALUES
+    ('a1', 'wrongtype', 'Det är ett päronträd', 'david', '2026-09-25 08:00');
+
+INSERT INTO history (at, op, tab, old_json, new_json) VALUES
+    ('2026-08-14 10:00+02', 'INSERT', 'trees', NULL,
+     '{"ssm_key": "a1", "type": "Äppelträd", "description": "Stort träd vid lekplatsen", "img": "a1img", "added_by": "anna", "added_at": "2026-08-14T10:00:00", "point": {"type": "Point", "coordinates": [13.0038, 55.6050]}}'),
+    ('2026-09-02 09:30+02', 'INSERT', 'trees', NULL,
+     '{"ssm_key": "p2", "type": "Päronträd", "description": "Söta päron", "img": "p2img", "added_by": "bertil", "added_at": "2026-09-02T09:30:00", "point": {"type": "Point", "coordinates": [11.9746, 57.7089]}}'),
+    ('2026-09-05 14:00+02', 'UPDATE', 'trees',
+     '{"ssm_key": "p2", "type": "Päronträd", "description": "Söta päron", "img": "p2img", "added_by": "bertil", "added_at": "2026-09-02T09:30:00", "point": {"type": "Point", "coordinates": [11.9746, 57.7089]}}',
+     '{"ssm_key": "p2", "type": "Päronträd", "description": "Söta päron i oktober", "img": "p2img2", "added_by": "bertil", "added_at": "2026-09-02T09:30:00", "point": {"type": "Point", "coordinates": [11.9746, 57.7089]}}'),
+    ('2026-09-10 18:15+02', 'INSERT', 'trees', NULL,
+     '{"ssm_key": "k3", "type": "Körsbärsträd", "description": "", "img": null, "added_by": "cecilia", "added_at": "2026-09-10T18:15:00", "point": {"type": "Point", "coordinates": [18.0686, 59.3293]}}'),
+    ('2026-09-12 07:45+02', 'INSERT', 'trees', NULL,
+     '{"ssm_key": "d5", "type": "Plommonträd", "description": "Borta nu", "img": "d5img", "added_by": "erik", "added_at": "2026-09-12T07:45:00", "point": {"type": "Point", "coordinates": [17.6389, 59.8586]}}'),
+    ('2026-09-15 11:00+02', 'INSERT', 'flags', NULL,
+     '{"tree": "d5", "flag": "delete", "reason": "Trädet är nedhugget", "flagged_by": "frida", "flagged_at": "2026-09-15T11:00:00"}'),
+    ('2026-09-18 16:20+02', 'DELETE', 'flags',
+     '{"tree": "d5", "flag": "delete", "reason": "Trädet är nedhugget", "flagged_by": "frida", "flagged_at": "2026-09-15T11:00:00"}', NULL),
+    ('2026-09-18 16:20+02', 'DELETE', 'trees',
+     '{"ssm_key": "d5", "type": "Plommonträd", "description": "Borta nu", "img": "d5img", "added_by": "erik", "added_at": "2026-09-12T07:45:00", "point": {"type": "Point", "coordinates": [17.6389, 59.8586]}}', NULL),
+    ('2026-09-20 12:00+02', 'INSERT', 'trees', NULL,
+     '{"ssm_key": "x4", "type": "Okänd frukt", "description": "Vet inte vad det är", "img": "x4img", "added_by": "anna", "added_at": "2026-09-20T12:00:00", "point": {"type": "Point", "coordinates": [14.5000, 63.1800]}}'),
+    ('2026-09-25 08:00+02', 'INSERT', 'flags', NULL,
+     '{"tree": "a1", "flag": "wrongtype", "reason": "Det är ett päronträd", "flagged_by": "david", "flagged_at": "2026-09-25T08:00:00"}'),
+    ('2026-09-26 20:00+02', 'INSERT', 'comments', NULL, '{"id": 1, "text": "Fin karta"}');